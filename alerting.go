@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/notifier"
+)
+
+// alertingConfig configures how the alerts of alerting rules are sent to
+// Alertmanagers, and how their state is restored after restarts.
+type alertingConfig struct {
+	Alertmanagers   []string       `yaml:"alertmanagers,omitempty"`
+	Timeout         model.Duration `yaml:"timeout"`
+	ExternalURL     string         `yaml:"external_url,omitempty"`
+	OutageTolerance model.Duration `yaml:"outage_tolerance"`
+	ForGracePeriod  model.Duration `yaml:"for_grace_period"`
+	ResendDelay     model.Duration `yaml:"resend_delay"`
+}
+
+func (c *alertingConfig) setDefaults() {
+	if c.Timeout == 0 {
+		c.Timeout = model.Duration(10 * time.Second)
+	}
+	if c.OutageTolerance == 0 {
+		c.OutageTolerance = model.Duration(time.Hour)
+	}
+	if c.ForGracePeriod == 0 {
+		c.ForGracePeriod = model.Duration(10 * time.Minute)
+	}
+	if c.ResendDelay == 0 {
+		c.ResendDelay = model.Duration(time.Minute)
+	}
+}
+
+func (c *alertingConfig) validate() error {
+	for _, am := range c.Alertmanagers {
+		if err := validateHTTPURL(am); err != nil {
+			return fmt.Errorf("invalid Alertmanager URL: %v", err)
+		}
+	}
+	if c.ExternalURL != "" {
+		if err := validateHTTPURL(c.ExternalURL); err != nil {
+			return fmt.Errorf("invalid alerting external_url: %v", err)
+		}
+	}
+	if c.Timeout < 0 || c.OutageTolerance < 0 || c.ForGracePeriod < 0 || c.ResendDelay < 0 {
+		return fmt.Errorf("alerting durations must not be negative")
+	}
+	return nil
+}
+
+func validateHTTPURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("%q is not an absolute HTTP URL", s)
+	}
+	return nil
+}
+
+// alertmanagerNotifier sends the alerts of alerting rules to the Alertmanager
+// API v2. Alerts are queued, so that rule evaluations do not wait for the
+// Alertmanagers to respond.
+type alertmanagerNotifier struct {
+	client        *http.Client
+	alertmanagers []string
+	queue         chan []*notifier.Alert
+	done          chan struct{}
+
+	// Guards closing the queue, so that alerts are not sent after stopping,
+	// like by rule evaluations which are still running.
+	mtx     sync.Mutex
+	stopped bool
+}
+
+// How many batches of alerts are queued before dropping further alerts.
+const alertQueueCapacity = 100
+
+func newAlertmanagerNotifier(conf *alertingConfig) *alertmanagerNotifier {
+	return &alertmanagerNotifier{
+		client:        &http.Client{Timeout: time.Duration(conf.Timeout)},
+		alertmanagers: conf.Alertmanagers,
+		queue:         make(chan []*notifier.Alert, alertQueueCapacity),
+		done:          make(chan struct{}),
+	}
+}
+
+// Send implements rules.Sender. After stopping, alerts are dropped.
+func (n *alertmanagerNotifier) Send(alerts ...*notifier.Alert) {
+	n.mtx.Lock()
+	defer n.mtx.Unlock()
+	if n.stopped {
+		logger.Debug("Alerting has been stopped, dropping alerts", "count", len(alerts))
+		return
+	}
+	select {
+	case n.queue <- alerts:
+	default:
+		metrics.dropAlerts(len(alerts))
+		logger.Warn("Alert queue is full, dropping alerts", "count", len(alerts))
+	}
+}
+
+func (n *alertmanagerNotifier) run() {
+	go func() {
+		defer close(n.done)
+		for alerts := range n.queue {
+			body, err := json.Marshal(alerts)
+			if err != nil {
+				logger.Error("Encoding alerts failed", "err", err)
+				continue
+			}
+			for _, am := range n.alertmanagers {
+				err := n.post(am, body)
+				metrics.observeAlerts(am, len(alerts), err)
+				if err != nil {
+					logger.Error("Sending alerts to Alertmanager failed", "alertmanager", am, "count", len(alerts), "err", err)
+				}
+			}
+		}
+	}()
+}
+
+func (n *alertmanagerNotifier) post(alertmanager string, body []byte) error {
+	req, err := http.NewRequestWithContext(context.Background(), "POST", strings.TrimRight(alertmanager, "/")+"/api/v2/alerts", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Stop accepting alerts, waiting for the queued alerts to be sent.
+func (n *alertmanagerNotifier) stop() {
+	n.mtx.Lock()
+	if !n.stopped {
+		n.stopped = true
+		close(n.queue)
+	}
+	n.mtx.Unlock()
+	<-n.done
+}
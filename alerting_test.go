@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/notifier"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAlertingConfigValidate(t *testing.T) {
+	conf := alertingConfig{Alertmanagers: []string{"http://localhost:9093", "https://alertmanager.example.com/prefix"}}
+	conf.setDefaults()
+	require.NoError(t, conf.validate())
+	require.Equal(t, model.Duration(10*time.Second), conf.Timeout)
+	require.Equal(t, model.Duration(time.Hour), conf.OutageTolerance)
+	require.Equal(t, model.Duration(10*time.Minute), conf.ForGracePeriod)
+	require.Equal(t, model.Duration(time.Minute), conf.ResendDelay)
+
+	for _, conf := range []alertingConfig{
+		{Alertmanagers: []string{"localhost:9093"}},
+		{Alertmanagers: []string{"ftp://localhost:9093"}},
+		{Alertmanagers: []string{"http://"}},
+		{ExternalURL: "/prometheus"},
+		{ResendDelay: model.Duration(-time.Second)},
+	} {
+		require.Error(t, conf.validate(), conf)
+	}
+}
+
+func TestAlertmanagerNotifier(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	var mtx sync.Mutex
+	received := []*notifier.Alert{}
+	alertmanager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "POST", r.Method)
+		require.Equal(t, "/prefix/api/v2/alerts", r.URL.Path)
+		require.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		var alerts []*notifier.Alert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+		mtx.Lock()
+		defer mtx.Unlock()
+		received = append(received, alerts...)
+	}))
+	defer alertmanager.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer failing.Close()
+
+	conf := alertingConfig{Alertmanagers: []string{alertmanager.URL + "/prefix/", failing.URL}}
+	conf.setDefaults()
+	n := newAlertmanagerNotifier(&conf)
+	n.run()
+	startsAt := time.Unix(1700000000, 0).UTC()
+	n.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "DiskFull"), StartsAt: startsAt})
+	n.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "Down")}, &notifier.Alert{Labels: labels.FromStrings("alertname", "Slow")})
+	// Stopping waits for the queued alerts to be sent.
+	n.stop()
+	// Afterwards, alerts are dropped.
+	n.Send(&notifier.Alert{Labels: labels.FromStrings("alertname", "Late")})
+	n.stop()
+
+	require.Len(t, received, 3)
+	require.Equal(t, "DiskFull", received[0].Labels.Get("alertname"))
+	require.Equal(t, startsAt, received[0].StartsAt)
+	require.Equal(t, 3.0, testutil.ToFloat64(metrics.alertsSent.WithLabelValues(alertmanager.URL+"/prefix/")))
+	require.Equal(t, 0.0, testutil.ToFloat64(metrics.alertErrors.WithLabelValues(alertmanager.URL+"/prefix/")))
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.alertErrors.WithLabelValues(failing.URL)))
+}
+
+func TestAlertmanagerNotifierQueueFull(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	conf := alertingConfig{}
+	conf.setDefaults()
+	n := newAlertmanagerNotifier(&conf)
+	// Without running the notifier, the queue is not drained.
+	for i := 0; i < alertQueueCapacity+1; i++ {
+		n.Send(&notifier.Alert{}, &notifier.Alert{})
+	}
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.alertsDropped))
+}
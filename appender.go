@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/storage"
+)
+
+// crateAppender collects samples appended by the scrape or rule manager, and
+// writes them using a single request on commit.
+type crateAppender struct {
+	ctx context.Context
+	ca  *crateDbPrometheusAdapter
+	req *prompb.WriteRequest
+	// Index of the series in the request, by the hash of its labels.
+	series     map[uint64]int
+	histograms int
+}
+
+func newCrateAppender(ctx context.Context, ca *crateDbPrometheusAdapter) *crateAppender {
+	return &crateAppender{ctx: ctx, ca: ca, req: &prompb.WriteRequest{}, series: map[uint64]int{}}
+}
+
+func (a *crateAppender) add(ls labels.Labels, t int64, v float64) storage.SeriesRef {
+	hash := ls.Hash()
+	i, ok := a.series[hash]
+	if !ok {
+		i = len(a.req.Timeseries)
+		a.series[hash] = i
+		a.req.Timeseries = append(a.req.Timeseries, prompb.TimeSeries{Labels: prompb.FromLabels(ls, nil)})
+	}
+	a.req.Timeseries[i].Samples = append(a.req.Timeseries[i].Samples, prompb.Sample{Timestamp: t, Value: v})
+	return storage.SeriesRef(hash)
+}
+
+// Native histograms can not be stored in the metrics table, so they are only counted.
+func (a *crateAppender) dropHistogram(ls labels.Labels) storage.SeriesRef {
+	a.histograms++
+	return storage.SeriesRef(ls.Hash())
+}
+
+func (a *crateAppender) Commit() error {
+	defer a.Rollback()
+	if a.histograms > 0 {
+		metrics.dropSamples("unsupported_type", a.histograms)
+	}
+	request := writesToCrateRequest(a.req, a.ca.writeRelabelConfigs)
+	if a.ca.cardinality != nil {
+		request = a.ca.cardinality.filter(request)
+	}
+	if len(request.rows) == 0 {
+		return nil
+	}
+	err := a.ca.write(a.ctx, request)
+	if writeErr, ok := asWriteError(err); ok && writeErr.permanent {
+		metrics.dropSamples(writeErr.reason, writeErr.failed)
+	}
+	return err
+}
+
+func (a *crateAppender) Rollback() error {
+	a.req = &prompb.WriteRequest{}
+	a.series = map[uint64]int{}
+	a.histograms = 0
+	return nil
+}
@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql/parser"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"golang.org/x/sync/errgroup"
+)
+
+// stringList collects the values of a repeatable command line flag.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// Parse a point in time given as RFC 3339 timestamp, or as Unix timestamp in
+// seconds, into milliseconds.
+func parseTimestamp(s string) (int64, error) {
+	if t, err := strconv.ParseFloat(s, 64); err == nil {
+		return int64(t * 1000), nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q, use RFC 3339 or Unix timestamps", s)
+	}
+	return t.UnixMilli(), nil
+}
+
+// Parse series selectors, like `{job="node"}`. Without selectors, all series are selected.
+func parseSelectors(selectors []string) ([][]*labels.Matcher, error) {
+	if len(selectors) == 0 {
+		return [][]*labels.Matcher{{labels.MustNewMatcher(labels.MatchRegexp, labels.MetricName, ".+")}}, nil
+	}
+	matcherSets := make([][]*labels.Matcher, 0, len(selectors))
+	for _, s := range selectors {
+		matchers, err := parser.NewParser(parser.Options{}).ParseMetricSelector(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid series selector %q: %v", s, err)
+		}
+		matcherSets = append(matcherSets, matchers)
+	}
+	return matcherSets, nil
+}
+
+// backfillCheckpoint records the progress of a backfill per block, so that an
+// interrupted backfill can be resumed. It is saved after every written batch.
+type backfillCheckpoint struct {
+	mtx  sync.Mutex
+	file string
+
+	Start    int64                     `json:"start"`
+	End      int64                     `json:"end"`
+	Matchers []string                  `json:"matchers"`
+	Blocks   map[string]*blockProgress `json:"blocks"`
+}
+
+type blockProgress struct {
+	Done    bool  `json:"done"`
+	Samples int64 `json:"samples"`
+	// The last series of which all samples have been written. Series are
+	// read in order of their labels, so that all prior series can be skipped.
+	LastSeries labels.Labels `json:"last_series,omitempty"`
+}
+
+// Load the checkpoint file, if it exists. A checkpoint can only be resumed
+// with the same time range and selectors.
+func loadBackfillCheckpoint(file string, start int64, end int64, selectors []string) (*backfillCheckpoint, error) {
+	c := &backfillCheckpoint{file: file, Start: start, End: end, Matchers: selectors, Blocks: map[string]*blockProgress{}}
+	if file == "" {
+		return c, nil
+	}
+	content, err := os.ReadFile(file)
+	if errors.Is(err, os.ErrNotExist) {
+		return c, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading checkpoint file %q failed: %v", file, err)
+	}
+	saved := &backfillCheckpoint{}
+	if err := json.Unmarshal(content, saved); err != nil {
+		return nil, fmt.Errorf("reading checkpoint file %q failed: %v", file, err)
+	}
+	if saved.Start != start || saved.End != end || strings.Join(saved.Matchers, ",") != strings.Join(selectors, ",") {
+		return nil, fmt.Errorf("checkpoint file %q was created using a different time range or selectors", file)
+	}
+	if saved.Blocks != nil {
+		c.Blocks = saved.Blocks
+	}
+	return c, nil
+}
+
+// Get the progress of a block, creating it when the block has not been started yet.
+func (c *backfillCheckpoint) block(id string) blockProgress {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if c.Blocks[id] == nil {
+		c.Blocks[id] = &blockProgress{}
+	}
+	return *c.Blocks[id]
+}
+
+// Update the progress of a block, and save the checkpoint.
+func (c *backfillCheckpoint) update(id string, progress blockProgress) error {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.Blocks[id] = &progress
+	if c.file == "" {
+		return nil
+	}
+	content, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	// Replace the file atomically, so that it is not corrupted on interruption.
+	tmp := c.file + ".tmp"
+	if err := os.WriteFile(tmp, content, 0o644); err != nil {
+		return fmt.Errorf("writing checkpoint file failed: %v", err)
+	}
+	if err := os.Rename(tmp, c.file); err != nil {
+		return fmt.Errorf("writing checkpoint file failed: %v", err)
+	}
+	return nil
+}
+
+// backfiller writes the samples of TSDB blocks to CrateDB.
+type backfiller struct {
+	ep             endpoint.Endpoint
+	relabelConfigs []*relabel.Config
+	start          int64
+	end            int64
+	matcherSets    [][]*labels.Matcher
+	parallelism    int
+	batchSize      int
+	checkpoint     *backfillCheckpoint
+}
+
+// Backfill all blocks overlapping the time range, using one worker per block.
+func (b *backfiller) run(ctx context.Context, blocks []tsdb.BlockReader) error {
+	g, ctx := errgroup.WithContext(ctx)
+	g.SetLimit(b.parallelism)
+	for _, block := range blocks {
+		meta := block.Meta()
+		// The maximum time of blocks is exclusive.
+		if meta.MaxTime <= b.start || meta.MinTime > b.end {
+			continue
+		}
+		g.Go(func() error {
+			return b.backfillBlock(ctx, block)
+		})
+	}
+	return g.Wait()
+}
+
+// headBlock is a block written from the head of a TSDB data directory, which is
+// identified as `head` in checkpoints, because its ULID changes on every run.
+type headBlock struct {
+	tsdb.BlockReader
+}
+
+func blockID(block tsdb.BlockReader) string {
+	if _, ok := block.(headBlock); ok {
+		return "head"
+	}
+	return block.Meta().ULID.String()
+}
+
+// Open the blocks of a TSDB data directory or snapshot, including the head with
+// the most recent samples, which have not been compacted into a block yet. The
+// head is read from the write-ahead log and written as block into `tmpDir`.
+func openBackfillBlocks(db *tsdb.DBReadOnly, dir string, tmpDir string) ([]tsdb.BlockReader, func(), error) {
+	// Flush the head first, as it reopens the blocks, closing those opened
+	// before. Snapshots do not contain a write-ahead log.
+	if _, err := os.Stat(filepath.Join(dir, "wal")); err == nil {
+		if err := db.FlushWAL(tmpDir); err != nil {
+			return nil, nil, fmt.Errorf("error reading write-ahead log: %v", err)
+		}
+	}
+	blocks, err := db.Blocks()
+	if err != nil {
+		return nil, nil, err
+	}
+	var heads []*tsdb.Block
+	closeHeads := func() {
+		for _, head := range heads {
+			head.Close()
+		}
+	}
+	entries, err := os.ReadDir(tmpDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, entry := range entries {
+		head, err := tsdb.OpenBlock(logger, filepath.Join(tmpDir, entry.Name()), nil, nil)
+		if err != nil {
+			closeHeads()
+			return nil, nil, fmt.Errorf("error reading write-ahead log: %v", err)
+		}
+		heads = append(heads, head)
+		blocks = append(blocks, headBlock{head})
+	}
+	return blocks, closeHeads, nil
+}
+
+func (b *backfiller) backfillBlock(ctx context.Context, block tsdb.BlockReader) error {
+	id := blockID(block)
+	progress := b.checkpoint.block(id)
+	if progress.Done {
+		logger.Info("Skipping block, which has been backfilled already", "block", id)
+		return nil
+	}
+	logger.Info("Backfilling block", "block", id, "resume_after", progress.LastSeries.String())
+
+	querier, err := tsdb.NewBlockQuerier(block, b.start, b.end)
+	if err != nil {
+		return fmt.Errorf("error opening block %s: %v", id, err)
+	}
+	defer querier.Close()
+
+	// Select sorted series, and merge the results of multiple selectors.
+	sets := make([]storage.SeriesSet, 0, len(b.matcherSets))
+	for _, matchers := range b.matcherSets {
+		sets = append(sets, querier.Select(ctx, true, nil, matchers...))
+	}
+	set := storage.NewMergeSeriesSet(sets, 0, storage.ChainedSeriesMerge)
+
+	req := &prompb.WriteRequest{}
+	pending := 0
+	histograms := 0
+	var completed labels.Labels
+	flush := func() error {
+		if pending > 0 {
+			if _, err := b.ep(ctx, writesToCrateRequest(req, b.relabelConfigs)); err != nil {
+				return fmt.Errorf("error writing samples of block %s: %w", id, err)
+			}
+		}
+		progress.Samples += int64(pending)
+		if !completed.IsEmpty() {
+			progress.LastSeries = completed
+		}
+		req.Timeseries = req.Timeseries[:0]
+		pending = 0
+		return b.checkpoint.update(id, progress)
+	}
+
+	var it chunkenc.Iterator
+	for set.Next() {
+		series := set.At()
+		lset := series.Labels().Copy()
+		if !progress.LastSeries.IsEmpty() && labels.Compare(lset, progress.LastSeries) <= 0 {
+			continue
+		}
+		ts := prompb.TimeSeries{Labels: prompb.FromLabels(lset, nil)}
+		it = series.Iterator(it)
+		for vt := it.Next(); vt != chunkenc.ValNone; vt = it.Next() {
+			if vt != chunkenc.ValFloat {
+				// Native histograms can not be stored in the metrics table.
+				histograms++
+				continue
+			}
+			t, v := it.At()
+			ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: v})
+			// Split large series across batches.
+			if pending+len(ts.Samples) >= b.batchSize {
+				req.Timeseries = append(req.Timeseries, ts)
+				pending += len(ts.Samples)
+				if err := flush(); err != nil {
+					return err
+				}
+				ts = prompb.TimeSeries{Labels: ts.Labels}
+			}
+		}
+		if err := it.Err(); err != nil {
+			return fmt.Errorf("error reading series %s of block %s: %v", lset, id, err)
+		}
+		if len(ts.Samples) > 0 {
+			req.Timeseries = append(req.Timeseries, ts)
+			pending += len(ts.Samples)
+		}
+		completed = lset
+	}
+	if err := set.Err(); err != nil {
+		return fmt.Errorf("error reading block %s: %v", id, err)
+	}
+	if err := flush(); err != nil {
+		return err
+	}
+	progress.Done = true
+	if err := b.checkpoint.update(id, progress); err != nil {
+		return err
+	}
+	if histograms > 0 {
+		logger.Warn("Skipped native histogram samples", "block", id, "samples", histograms)
+	}
+	logger.Info("Backfilled block", "block", id, "samples", progress.Samples)
+	return nil
+}
+
+// Run the `backfill` subcommand, writing the samples of a Prometheus TSDB data
+// directory or snapshot to CrateDB.
+func runBackfill(args []string) error {
+	fs := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: cratedb-prometheus-adapter backfill [flags] <tsdb path>")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config.file", "", "Path to the CrateDB endpoints configuration file.")
+	start := fs.String("start", "", "Only backfill samples from this time on, as RFC 3339 or Unix timestamp (default: all).")
+	end := fs.String("end", "", "Only backfill samples up to this time, as RFC 3339 or Unix timestamp (default: all).")
+	parallelism := fs.Int("parallelism", 4, "Number of blocks to backfill concurrently.")
+	batchSize := fs.Int("batch-size", 5000, "Maximum number of samples per write request.")
+	checkpointFile := fs.String("checkpoint.file", "", "Path to a file to record the progress in, for resuming interrupted backfills.")
+	var selectors stringList
+	fs.Var(&selectors, "match", "Series selector, like `{job=\"node\"}`. Can be repeated (default: all series).")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return fmt.Errorf("expected the path of a TSDB data directory or snapshot")
+	}
+	if *parallelism < 1 || *batchSize < 1 {
+		return fmt.Errorf("parallelism and batch size must be positive")
+	}
+
+	b := &backfiller{parallelism: *parallelism, batchSize: *batchSize, start: 0, end: 1<<63 - 1}
+	var err error
+	if *start != "" {
+		if b.start, err = parseTimestamp(*start); err != nil {
+			return err
+		}
+	}
+	if *end != "" {
+		if b.end, err = parseTimestamp(*end); err != nil {
+			return err
+		}
+	}
+	if b.matcherSets, err = parseSelectors(selectors); err != nil {
+		return err
+	}
+	if b.checkpoint, err = loadBackfillCheckpoint(*checkpointFile, b.start, b.end, selectors); err != nil {
+		return err
+	}
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	endpoints, ep, err := setupEndpoints(conf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, ep := range endpoints {
+			ep.close()
+		}
+	}()
+	b.ep = ep
+	b.relabelConfigs = conf.WriteRelabelConfigs
+
+	db, err := tsdb.OpenDBReadOnly(fs.Arg(0), "", logger)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	tmpDir, err := os.MkdirTemp("", "backfill-head-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tmpDir)
+	blocks, closeBlocks, err := openBackfillBlocks(db, fs.Arg(0), tmpDir)
+	if err != nil {
+		return err
+	}
+	defer closeBlocks()
+
+	// Stop on termination, keeping the checkpoint of the written batches.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return b.run(ctx, blocks)
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/stretchr/testify/require"
+)
+
+// Create a TSDB block with `n` samples per series, one per minute.
+func createTestBlock(t *testing.T, dir string, start int64, n int, series ...labels.Labels) {
+	w, err := tsdb.NewBlockWriter(promslog.NewNopLogger(), dir, 24*time.Hour.Milliseconds())
+	require.NoError(t, err)
+	defer w.Close()
+	app := w.Appender(context.Background())
+	for _, lset := range series {
+		for i := 0; i < n; i++ {
+			_, err := app.Append(0, lset, start+int64(i)*time.Minute.Milliseconds(), float64(i))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, app.Commit())
+	_, err = w.Flush(context.Background())
+	require.NoError(t, err)
+}
+
+func openTestBlocks(t *testing.T, dir string) []tsdb.BlockReader {
+	db, err := tsdb.OpenDBReadOnly(dir, "", promslog.NewNopLogger())
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	blocks, err := db.Blocks()
+	require.NoError(t, err)
+	return blocks
+}
+
+// recordingBackfiller returns a backfiller which records the written samples per series.
+func recordingBackfiller(t *testing.T, checkpointFile string, selectors ...string) (*backfiller, map[string]int, *int) {
+	var mtx sync.Mutex
+	samples := map[string]int{}
+	requests := 0
+	matcherSets, err := parseSelectors(selectors)
+	require.NoError(t, err)
+	checkpoint, err := loadBackfillCheckpoint(checkpointFile, 0, 1<<63-1, selectors)
+	require.NoError(t, err)
+	b := &backfiller{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			requests++
+			for _, row := range request.(*crateWriteRequest).rows {
+				samples[row.labels.String()]++
+			}
+			return nil, nil
+		},
+		start:       0,
+		end:         1<<63 - 1,
+		matcherSets: matcherSets,
+		parallelism: 2,
+		batchSize:   100,
+		checkpoint:  checkpoint,
+	}
+	return b, samples, &requests
+}
+
+func TestParseTimestamp(t *testing.T) {
+	ts, err := parseTimestamp("2026-01-02T03:04:05Z")
+	require.NoError(t, err)
+	require.Equal(t, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).UnixMilli(), ts)
+	ts, err = parseTimestamp("1767323045.5")
+	require.NoError(t, err)
+	require.Equal(t, int64(1767323045500), ts)
+	_, err = parseTimestamp("yesterday")
+	require.Error(t, err)
+}
+
+func TestBackfill(t *testing.T) {
+	dir := t.TempDir()
+	createTestBlock(t, dir, 0, 150,
+		labels.FromStrings("__name__", "up", "job", "node"),
+		labels.FromStrings("__name__", "up", "job", "prometheus"))
+	createTestBlock(t, dir, 7*24*time.Hour.Milliseconds(), 10,
+		labels.FromStrings("__name__", "go_goroutines", "job", "node"))
+	blocks := openTestBlocks(t, dir)
+	require.Len(t, blocks, 2)
+
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	b, samples, requests := recordingBackfiller(t, checkpointFile)
+	require.NoError(t, b.run(context.Background(), blocks))
+	require.Equal(t, map[string]int{
+		`up{job="node"}`:            150,
+		`up{job="prometheus"}`:      150,
+		`go_goroutines{job="node"}`: 10,
+	}, samples)
+	// Large series are split into batches.
+	require.Equal(t, 4, *requests)
+
+	checkpoint, err := loadBackfillCheckpoint(checkpointFile, 0, 1<<63-1, nil)
+	require.NoError(t, err)
+	require.Len(t, checkpoint.Blocks, 2)
+	for _, progress := range checkpoint.Blocks {
+		require.True(t, progress.Done)
+	}
+
+	// Completed blocks are skipped.
+	b, samples, _ = recordingBackfiller(t, checkpointFile)
+	require.NoError(t, b.run(context.Background(), blocks))
+	require.Empty(t, samples)
+}
+
+func TestBackfillSelectors(t *testing.T) {
+	dir := t.TempDir()
+	createTestBlock(t, dir, 0, 10,
+		labels.FromStrings("__name__", "up", "job", "node"),
+		labels.FromStrings("__name__", "up", "job", "prometheus"),
+		labels.FromStrings("__name__", "go_goroutines", "job", "node"))
+	blocks := openTestBlocks(t, dir)
+
+	b, samples, _ := recordingBackfiller(t, "", `{job="prometheus"}`, `go_goroutines`)
+	require.NoError(t, b.run(context.Background(), blocks))
+	require.Equal(t, map[string]int{`up{job="prometheus"}`: 10, `go_goroutines{job="node"}`: 10}, samples)
+
+	// Only samples within the time range are written.
+	b, samples, _ = recordingBackfiller(t, "", `up`)
+	b.start = 2 * time.Minute.Milliseconds()
+	b.end = 5 * time.Minute.Milliseconds()
+	require.NoError(t, b.run(context.Background(), blocks))
+	require.Equal(t, map[string]int{`up{job="node"}`: 4, `up{job="prometheus"}`: 4}, samples)
+}
+
+func TestBackfillResume(t *testing.T) {
+	dir := t.TempDir()
+	series := []labels.Labels{
+		labels.FromStrings("__name__", "up", "job", "a"),
+		labels.FromStrings("__name__", "up", "job", "b"),
+		labels.FromStrings("__name__", "up", "job", "c"),
+	}
+	createTestBlock(t, dir, 0, 10, series...)
+	blocks := openTestBlocks(t, dir)
+	id := blocks[0].Meta().ULID.String()
+
+	// Pretend that the first series has been written before an interruption.
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	checkpoint, err := loadBackfillCheckpoint(checkpointFile, 0, 1<<63-1, nil)
+	require.NoError(t, err)
+	require.NoError(t, checkpoint.update(id, blockProgress{Samples: 10, LastSeries: series[0]}))
+
+	b, samples, _ := recordingBackfiller(t, checkpointFile)
+	require.NoError(t, b.run(context.Background(), blocks))
+	written := []string{}
+	for s := range samples {
+		written = append(written, s)
+	}
+	sort.Strings(written)
+	require.Equal(t, []string{`up{job="b"}`, `up{job="c"}`}, written)
+
+	checkpoint, err = loadBackfillCheckpoint(checkpointFile, 0, 1<<63-1, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(30), checkpoint.Blocks[id].Samples)
+	require.True(t, checkpoint.Blocks[id].Done)
+}
+
+func TestBackfillCheckpointMismatch(t *testing.T) {
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	require.NoError(t, os.WriteFile(checkpointFile, []byte(`{"start": 0, "end": 1000, "matchers": ["up"]}`), 0o644))
+	_, err := loadBackfillCheckpoint(checkpointFile, 0, 1000, []string{"up"})
+	require.NoError(t, err)
+	_, err = loadBackfillCheckpoint(checkpointFile, 0, 2000, []string{"up"})
+	require.ErrorContains(t, err, "different time range or selectors")
+}
+
+func TestBackfillHead(t *testing.T) {
+	dir := t.TempDir()
+	createTestBlock(t, dir, 0, 10, labels.FromStrings("__name__", "up", "job", "node"))
+
+	// Write samples into the head of a TSDB, which are only persisted in the
+	// write-ahead log.
+	start := 7 * 24 * time.Hour.Milliseconds()
+	db, err := tsdb.Open(dir, promslog.NewNopLogger(), nil, tsdb.DefaultOptions(), nil)
+	require.NoError(t, err)
+	app := db.Appender(context.Background())
+	for i := 0; i < 20; i++ {
+		_, err := app.Append(0, labels.FromStrings("__name__", "up", "job", "node"), start+int64(i)*time.Minute.Milliseconds(), float64(i))
+		require.NoError(t, err)
+	}
+	require.NoError(t, app.Commit())
+	require.NoError(t, db.Close())
+
+	readOnly, err := tsdb.OpenDBReadOnly(dir, "", promslog.NewNopLogger())
+	require.NoError(t, err)
+	defer readOnly.Close()
+	blocks, closeBlocks, err := openBackfillBlocks(readOnly, dir, t.TempDir())
+	require.NoError(t, err)
+	defer closeBlocks()
+	require.Len(t, blocks, 2)
+	require.Equal(t, "head", blockID(blocks[1]))
+
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint.json")
+	b, samples, _ := recordingBackfiller(t, checkpointFile)
+	require.NoError(t, b.run(context.Background(), blocks))
+	require.Equal(t, map[string]int{`up{job="node"}`: 30}, samples)
+
+	checkpoint, err := loadBackfillCheckpoint(checkpointFile, 0, 1<<63-1, nil)
+	require.NoError(t, err)
+	require.Equal(t, int64(20), checkpoint.Blocks["head"].Samples)
+	require.True(t, checkpoint.Blocks["head"].Done)
+
+	// Snapshots without write-ahead log only consist of blocks.
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "wal")))
+	blocks, _, err = openBackfillBlocks(readOnly, dir, t.TempDir())
+	require.NoError(t, err)
+	require.Len(t, blocks, 1)
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+)
+
+const (
+	lbRoundRobin       = "round_robin"
+	lbRandom           = "random"
+	lbLeastOutstanding = "least_outstanding"
+	lbEWMALatency      = "ewma_latency"
+	lbWeighted         = "weighted"
+
+	// Weight of the most recent request latency in the moving average.
+	ewmaAlpha = 0.3
+
+	// How long the least_outstanding and ewma_latency strategies avoid an
+	// endpoint after a retriable failure, unless all endpoints have failed.
+	failureCooldown = 5 * time.Second
+)
+
+// loadBalancingConfig configures how requests are distributed across the
+// CrateDB endpoints, individually for read and write requests.
+type loadBalancingConfig struct {
+	Read  string `yaml:"read"`
+	Write string `yaml:"write"`
+}
+
+// UnmarshalYAML accepts either a single strategy for both read and write
+// requests, or a mapping with individual strategies.
+func (c *loadBalancingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var strategy string
+	if err := unmarshal(&strategy); err == nil {
+		c.Read = strategy
+		c.Write = strategy
+		return nil
+	}
+	type plain loadBalancingConfig
+	return unmarshal((*plain)(c))
+}
+
+func (c *loadBalancingConfig) validate() error {
+	for _, strategy := range []string{c.Read, c.Write} {
+		switch strategy {
+		case lbRoundRobin, lbRandom, lbLeastOutstanding, lbEWMALatency, lbWeighted:
+		default:
+			return fmt.Errorf("unknown load balancing strategy %q", strategy)
+		}
+	}
+	return nil
+}
+
+// balancedEndpoint keeps track of the number of in-flight requests, of the
+// request latency, and of the last failure of an endpoint.
+type balancedEndpoint struct {
+	ep          endpoint.Endpoint
+	weight      int
+	outstanding atomic.Int64
+
+	mtx    sync.Mutex
+	ewma   float64
+	failed time.Time
+
+	// Current weight for the smooth weighted round-robin strategy,
+	// guarded by the balancer.
+	current int
+}
+
+func newBalancedEndpoint(ep endpoint.Endpoint, weight int) *balancedEndpoint {
+	return &balancedEndpoint{ep: ep, weight: weight}
+}
+
+func (b *balancedEndpoint) endpoint(ctx context.Context, request interface{}) (interface{}, error) {
+	b.outstanding.Add(1)
+	defer b.outstanding.Add(-1)
+	start := time.Now()
+	response, err := b.ep(ctx, request)
+	// Failing endpoints often respond quickly, so the latency of failed
+	// requests would make them look cheapest.
+	if err != nil && isRetriable(err) {
+		b.fail(time.Now())
+	} else {
+		b.observe(time.Since(start))
+	}
+	return response, err
+}
+
+func (b *balancedEndpoint) fail(now time.Time) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	b.failed = now
+}
+
+// Whether the endpoint has not failed recently.
+func (b *balancedEndpoint) healthy(now time.Time) bool {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return now.Sub(b.failed) >= failureCooldown
+}
+
+func (b *balancedEndpoint) observe(d time.Duration) {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	if b.ewma == 0 {
+		b.ewma = d.Seconds()
+	} else {
+		b.ewma += ewmaAlpha * (d.Seconds() - b.ewma)
+	}
+}
+
+// Expected time to serve another request, taking queued requests into account.
+// Endpoints without any measurements yet are preferred, so that they are probed.
+func (b *balancedEndpoint) cost() float64 {
+	b.mtx.Lock()
+	defer b.mtx.Unlock()
+	return b.ewma * float64(b.outstanding.Load()+1)
+}
+
+// Create a balancer using the given strategy.
+func newBalancer(strategy string, endpoints []*balancedEndpoint) lb.Balancer {
+	endpointer := sd.FixedEndpointer{}
+	for _, b := range endpoints {
+		endpointer = append(endpointer, b.endpoint)
+	}
+	switch strategy {
+	case lbRandom:
+		return lb.NewRandom(endpointer, time.Now().UnixNano())
+	case lbLeastOutstanding:
+		return &selectingBalancer{endpoints: endpoints, score: func(b *balancedEndpoint) float64 {
+			return float64(b.outstanding.Load())
+		}}
+	case lbEWMALatency:
+		return &selectingBalancer{endpoints: endpoints, score: (*balancedEndpoint).cost}
+	case lbWeighted:
+		return &weightedBalancer{endpoints: endpoints}
+	default:
+		return lb.NewRoundRobin(endpointer)
+	}
+}
+
+// selectingBalancer picks the endpoint with the lowest score, preferring
+// endpoints which have not failed recently. This way, retries are sent to
+// other endpoints. Ties are broken by starting the search at a random endpoint.
+type selectingBalancer struct {
+	endpoints []*balancedEndpoint
+	score     func(b *balancedEndpoint) float64
+}
+
+func (s *selectingBalancer) Endpoint() (endpoint.Endpoint, error) {
+	if len(s.endpoints) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	now := time.Now()
+	offset := rand.Intn(len(s.endpoints))
+	var best *balancedEndpoint
+	bestScore, bestHealthy := 0.0, false
+	for i := range s.endpoints {
+		b := s.endpoints[(offset+i)%len(s.endpoints)]
+		score, healthy := s.score(b), b.healthy(now)
+		if best == nil || (healthy && !bestHealthy) || (healthy == bestHealthy && score < bestScore) {
+			best, bestScore, bestHealthy = b, score, healthy
+		}
+	}
+	return best.endpoint, nil
+}
+
+// weightedBalancer distributes requests proportionally to the endpoint weights,
+// using the smooth weighted round-robin algorithm of nginx.
+type weightedBalancer struct {
+	mtx       sync.Mutex
+	endpoints []*balancedEndpoint
+}
+
+func (w *weightedBalancer) Endpoint() (endpoint.Endpoint, error) {
+	w.mtx.Lock()
+	defer w.mtx.Unlock()
+	if len(w.endpoints) == 0 {
+		return nil, lb.ErrNoEndpoints
+	}
+	var best *balancedEndpoint
+	total := 0
+	for _, b := range w.endpoints {
+		b.current += b.weight
+		total += b.weight
+		if best == nil || b.current > best.current {
+			best = b
+		}
+	}
+	best.current -= total
+	return best.endpoint, nil
+}
+
+// Dispatch read and write requests to individual endpoints.
+func dispatchByRequestType(read endpoint.Endpoint, write endpoint.Endpoint) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		if _, ok := request.(*crateReadRequest); ok {
+			return read(ctx, request)
+		}
+		return write(ctx, request)
+	}
+}
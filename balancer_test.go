@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestLoadBalancingConfigUnmarshal(t *testing.T) {
+	for _, tc := range []struct {
+		input    string
+		expected loadBalancingConfig
+	}{
+		{"least_outstanding", loadBalancingConfig{Read: lbLeastOutstanding, Write: lbLeastOutstanding}},
+		{"{read: ewma_latency, write: weighted}", loadBalancingConfig{Read: lbEWMALatency, Write: lbWeighted}},
+	} {
+		conf := loadBalancingConfig{}
+		require.NoError(t, yaml.UnmarshalStrict([]byte(tc.input), &conf))
+		require.Equal(t, tc.expected, conf)
+		require.NoError(t, conf.validate())
+	}
+
+	conf := loadBalancingConfig{}
+	require.NoError(t, yaml.UnmarshalStrict([]byte("{read: fastest, write: random}"), &conf))
+	require.EqualError(t, conf.validate(), `unknown load balancing strategy "fastest"`)
+	require.Error(t, yaml.UnmarshalStrict([]byte("{reads: random}"), &conf))
+}
+
+// Create balanced endpoints which count their requests.
+func countingEndpoints(weights ...int) ([]*balancedEndpoint, []int) {
+	counts := make([]int, len(weights))
+	endpoints := []*balancedEndpoint{}
+	for i, weight := range weights {
+		endpoints = append(endpoints, newBalancedEndpoint(func(ctx context.Context, request interface{}) (interface{}, error) {
+			counts[i]++
+			return nil, nil
+		}, weight))
+	}
+	return endpoints, counts
+}
+
+func callBalancer(t *testing.T, strategy string, endpoints []*balancedEndpoint, n int) {
+	balancer := newBalancer(strategy, endpoints)
+	for i := 0; i < n; i++ {
+		ep, err := balancer.Endpoint()
+		require.NoError(t, err)
+		_, err = ep(context.Background(), nil)
+		require.NoError(t, err)
+	}
+}
+
+func TestBalancerDistribution(t *testing.T) {
+	for _, strategy := range []string{lbRoundRobin, lbRandom, lbLeastOutstanding, lbEWMALatency, lbWeighted} {
+		endpoints, counts := countingEndpoints(1, 1)
+		callBalancer(t, strategy, endpoints, 100)
+		require.Equal(t, 100, counts[0]+counts[1], strategy)
+	}
+
+	endpoints, counts := countingEndpoints(3, 1)
+	callBalancer(t, lbWeighted, endpoints, 100)
+	require.Equal(t, []int{75, 25}, counts)
+
+	_, err := newBalancer(lbWeighted, nil).Endpoint()
+	require.Error(t, err)
+	_, err = newBalancer(lbLeastOutstanding, nil).Endpoint()
+	require.Error(t, err)
+}
+
+func TestBalancerLeastOutstanding(t *testing.T) {
+	endpoints, counts := countingEndpoints(1, 1)
+	endpoints[0].outstanding.Add(2)
+	callBalancer(t, lbLeastOutstanding, endpoints, 10)
+	require.Equal(t, []int{0, 10}, counts)
+}
+
+func TestBalancerFailure(t *testing.T) {
+	for _, strategy := range []string{lbLeastOutstanding, lbEWMALatency} {
+		counts := make([]int, 2)
+		errs := []error{errors.New("connection refused"), nil}
+		endpoints := []*balancedEndpoint{}
+		for i := range counts {
+			endpoints = append(endpoints, newBalancedEndpoint(func(ctx context.Context, request interface{}) (interface{}, error) {
+				counts[i]++
+				time.Sleep(time.Duration(i) * time.Millisecond)
+				return nil, errs[i]
+			}, 1))
+		}
+		balancer := newBalancer(strategy, endpoints)
+		for i := 0; i < 10; i++ {
+			ep, err := balancer.Endpoint()
+			require.NoError(t, err)
+			ep(context.Background(), nil)
+		}
+		// The failing endpoint is tried at most once, and its latency is not
+		// recorded, although it responds faster.
+		require.LessOrEqual(t, counts[0], 1, strategy)
+		require.Equal(t, 0.0, endpoints[0].ewma, strategy)
+
+		// When all endpoints have failed, they are used nonetheless.
+		endpoints[1].fail(time.Now())
+		ep, err := balancer.Endpoint()
+		require.NoError(t, err)
+		require.NotNil(t, ep)
+
+		// After the cooldown, the endpoint is used again.
+		endpoints[0].fail(time.Now().Add(-failureCooldown))
+		require.True(t, endpoints[0].healthy(time.Now()))
+	}
+
+	// Permanent errors do not indicate a failing endpoint.
+	b := newBalancedEndpoint(func(ctx context.Context, request interface{}) (interface{}, error) {
+		return nil, &pgconn.PgError{Code: "42P01"}
+	}, 1)
+	b.endpoint(context.Background(), nil)
+	require.True(t, b.healthy(time.Now()))
+}
+
+func TestBalancerEWMALatency(t *testing.T) {
+	endpoints, counts := countingEndpoints(1, 1)
+	endpoints[0].observe(200 * time.Millisecond)
+	endpoints[1].observe(10 * time.Millisecond)
+	endpoints[1].outstanding.Add(3)
+	// The faster endpoint stays cheaper, even with a few requests in flight.
+	require.Less(t, endpoints[1].cost(), endpoints[0].cost())
+	balancer := newBalancer(lbEWMALatency, endpoints)
+	ep, err := balancer.Endpoint()
+	require.NoError(t, err)
+	ep(context.Background(), nil)
+	require.Equal(t, []int{0, 1}, counts)
+
+	// The moving average follows the latency.
+	b := newBalancedEndpoint(nil, 1)
+	b.observe(10 * time.Millisecond)
+	b.observe(1010 * time.Millisecond)
+	require.InDelta(t, 0.31, b.ewma, 0.0001)
+}
+
+func TestDispatchByRequestType(t *testing.T) {
+	called := ""
+	named := func(name string) endpoint.Endpoint {
+		return func(ctx context.Context, request interface{}) (interface{}, error) {
+			called = name
+			return nil, nil
+		}
+	}
+	ep := dispatchByRequestType(named("read"), named("write"))
+	ep(context.Background(), &crateReadRequest{})
+	require.Equal(t, "read", called)
+	ep(context.Background(), &crateWriteRequest{})
+	require.Equal(t, "write", called)
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"math/bits"
+	"math/rand/v2"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	cardinalityModeExact       = "exact"
+	cardinalityModeHyperLogLog = "hyperloglog"
+
+	// Precision of the HyperLogLog sketches, yielding 4096 registers per
+	// sketch and a standard error of about 1.6%.
+	hllPrecision = 12
+
+	// How often per window inactive series are expired in exact mode. Series
+	// remain active for up to 1/16 of the window longer, in exchange for not
+	// walking all series on every write.
+	cardinalityExpireSteps = 16
+)
+
+type cardinalityConfig struct {
+	Enabled            bool           `yaml:"enabled"`
+	Mode               string         `yaml:"mode"`
+	ActiveWindow       model.Duration `yaml:"active_window"`
+	MaxSeriesPerMetric int            `yaml:"max_series_per_metric"`
+	MaxSeriesTotal     int            `yaml:"max_series_total"`
+}
+
+func (c *cardinalityConfig) validate() error {
+	switch c.Mode {
+	case cardinalityModeExact:
+	case cardinalityModeHyperLogLog:
+		// Sketches can only estimate counts, they cannot tell whether an
+		// individual series has been seen before.
+		if c.MaxSeriesPerMetric != 0 || c.MaxSeriesTotal != 0 {
+			return fmt.Errorf("series limits require cardinality mode %q", cardinalityModeExact)
+		}
+	default:
+		return fmt.Errorf("unknown cardinality mode %q", c.Mode)
+	}
+	if c.ActiveWindow <= 0 {
+		return fmt.Errorf("cardinality active_window must be positive")
+	}
+	return nil
+}
+
+// cardinalityTracker keeps track of the active `labels_hash` values per metric
+// name. A series is considered active when it has been written within the
+// configured window.
+type cardinalityTracker struct {
+	mtx          sync.Mutex
+	mode         string
+	window       time.Duration
+	maxPerMetric int
+	maxTotal     int
+	now          func() time.Time
+
+	// Exact mode: last write time per series, keyed by metric name and labels hash.
+	series  map[string]map[string]time.Time
+	total   int
+	expired time.Time
+
+	// HyperLogLog mode: two generations of sketches, rotated every window.
+	current  map[string]*hyperLogLog
+	previous map[string]*hyperLogLog
+	rotated  time.Time
+
+	activeSeriesDesc      *prometheus.Desc
+	activeSeriesTotalDesc *prometheus.Desc
+}
+
+type cardinalityEntry struct {
+	Name   string `json:"name"`
+	Series int    `json:"series"`
+}
+
+type cardinalityStatus struct {
+	Mode   string             `json:"mode"`
+	Total  int                `json:"total"`
+	Limit  int                `json:"limit,omitempty"`
+	Top    []cardinalityEntry `json:"top"`
+	Window string             `json:"active_window"`
+}
+
+func newCardinalityTracker(conf *cardinalityConfig) *cardinalityTracker {
+	return &cardinalityTracker{
+		mode:         conf.Mode,
+		window:       time.Duration(conf.ActiveWindow),
+		maxPerMetric: conf.MaxSeriesPerMetric,
+		maxTotal:     conf.MaxSeriesTotal,
+		now:          time.Now,
+		series:       map[string]map[string]time.Time{},
+		current:      map[string]*hyperLogLog{},
+		previous:     map[string]*hyperLogLog{},
+		rotated:      time.Now(),
+		activeSeriesDesc: prometheus.NewDesc(
+			metrics.prefix+"active_series",
+			"Number of active series per metric name.",
+			[]string{"metric"}, nil,
+		),
+		activeSeriesTotalDesc: prometheus.NewDesc(
+			metrics.prefix+"active_series_total",
+			"Number of active series across all metric names.",
+			nil, nil,
+		),
+	}
+}
+
+// filter records all series of the write request, and returns a request which
+// only contains rows whose series are within the configured limits.
+func (t *cardinalityTracker) filter(req *crateWriteRequest) *crateWriteRequest {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	now := t.now()
+	if t.mode == cardinalityModeHyperLogLog {
+		t.rotate(now)
+		for _, row := range req.rows {
+			name := string(row.labels[model.MetricNameLabel])
+			sketch, ok := t.current[name]
+			if !ok {
+				sketch = newHyperLogLog(hllPrecision)
+				t.current[name] = sketch
+			}
+			sketch.add(row.labelsHash)
+		}
+		return req
+	}
+
+	t.expire(now)
+	accepted := req.rows[:0:0]
+	for _, row := range req.rows {
+		name := string(row.labels[model.MetricNameLabel])
+		known, ok := t.series[name]
+		if !ok {
+			known = map[string]time.Time{}
+		}
+		if _, ok := known[row.labelsHash]; !ok {
+			if t.maxTotal > 0 && t.total >= t.maxTotal {
+				metrics.dropSamples("max_series_total", 1)
+				continue
+			}
+			if t.maxPerMetric > 0 && len(known) >= t.maxPerMetric {
+				metrics.dropSamples("max_series_per_metric", 1)
+				continue
+			}
+			t.total++
+			t.series[name] = known
+		}
+		known[row.labelsHash] = now
+		accepted = append(accepted, row)
+	}
+	return &crateWriteRequest{rows: accepted}
+}
+
+// expire forgets about series which have not been written within the window.
+// As this walks all series, it only runs once per fraction of the window.
+func (t *cardinalityTracker) expire(now time.Time) {
+	if now.Sub(t.expired) < t.window/cardinalityExpireSteps {
+		return
+	}
+	t.expired = now
+	for name, known := range t.series {
+		for hash, seen := range known {
+			if now.Sub(seen) > t.window {
+				delete(known, hash)
+				t.total--
+			}
+		}
+		if len(known) == 0 {
+			delete(t.series, name)
+		}
+	}
+}
+
+// rotate starts a new sketch generation once the window has elapsed.
+func (t *cardinalityTracker) rotate(now time.Time) {
+	if now.Sub(t.rotated) < t.window {
+		return
+	}
+	t.previous = t.current
+	t.current = map[string]*hyperLogLog{}
+	t.rotated = now
+}
+
+// counts returns the number of active series per metric name.
+func (t *cardinalityTracker) counts() map[string]int {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	counts := map[string]int{}
+	if t.mode == cardinalityModeHyperLogLog {
+		names := map[string]struct{}{}
+		for name := range t.current {
+			names[name] = struct{}{}
+		}
+		for name := range t.previous {
+			names[name] = struct{}{}
+		}
+		for name := range names {
+			sketch := newHyperLogLog(hllPrecision)
+			sketch.merge(t.current[name])
+			sketch.merge(t.previous[name])
+			counts[name] = int(sketch.estimate())
+		}
+		return counts
+	}
+
+	t.expire(t.now())
+	for name, known := range t.series {
+		counts[name] = len(known)
+	}
+	return counts
+}
+
+// status returns the total number of active series and the top-n metric names
+// by number of active series.
+func (t *cardinalityTracker) status(n int) *cardinalityStatus {
+	status := &cardinalityStatus{
+		Mode:   t.mode,
+		Limit:  t.maxTotal,
+		Top:    []cardinalityEntry{},
+		Window: model.Duration(t.window).String(),
+	}
+	for name, count := range t.counts() {
+		status.Total += count
+		status.Top = append(status.Top, cardinalityEntry{Name: name, Series: count})
+	}
+	sort.Slice(status.Top, func(i, j int) bool {
+		if status.Top[i].Series != status.Top[j].Series {
+			return status.Top[i].Series > status.Top[j].Series
+		}
+		return status.Top[i].Name < status.Top[j].Name
+	})
+	if n > 0 && len(status.Top) > n {
+		status.Top = status.Top[:n]
+	}
+	return status
+}
+
+// handleStatus serves the top-N cardinality offenders as JSON.
+func (t *cardinalityTracker) handleStatus(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if s := r.URL.Query().Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", s), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.status(limit)); err != nil {
+		logger.Error("Failed to encode cardinality status", "err", err)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (t *cardinalityTracker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- t.activeSeriesDesc
+	ch <- t.activeSeriesTotalDesc
+}
+
+// Collect implements prometheus.Collector.
+func (t *cardinalityTracker) Collect(ch chan<- prometheus.Metric) {
+	total := 0
+	for name, count := range t.counts() {
+		total += count
+		ch <- prometheus.MustNewConstMetric(t.activeSeriesDesc, prometheus.GaugeValue, float64(count), name)
+	}
+	ch <- prometheus.MustNewConstMetric(t.activeSeriesTotalDesc, prometheus.GaugeValue, float64(total))
+}
+
+// hyperLogLog is a minimal HyperLogLog cardinality sketch.
+// See https://algo.inria.fr/flajolet/Publications/FlFuGaMe07.pdf.
+type hyperLogLog struct {
+	precision uint8
+	registers []uint8
+}
+
+// The hash seed is random, so that the registers of label sets cannot be
+// predicted. Tests set a fixed seed, to get reproducible estimates.
+var hllSeed = rand.Uint64()
+
+// Hash a string using seeded FNV-1a, followed by the SplitMix64 finalizer to
+// distribute the bits evenly.
+func hllHash(seed uint64, s string) uint64 {
+	x := uint64(14695981039346656037) ^ seed
+	for i := 0; i < len(s); i++ {
+		x ^= uint64(s[i])
+		x *= 1099511628211
+	}
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func newHyperLogLog(precision uint8) *hyperLogLog {
+	return &hyperLogLog{
+		precision: precision,
+		registers: make([]uint8, 1<<precision),
+	}
+}
+
+func (h *hyperLogLog) add(s string) {
+	x := hllHash(hllSeed, s)
+	idx := x >> (64 - h.precision)
+	rank := uint8(bits.LeadingZeros64(x<<h.precision|1<<(h.precision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) merge(other *hyperLogLog) {
+	if other == nil {
+		return
+	}
+	for i, r := range other.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+func (h *hyperLogLog) estimate() float64 {
+	m := float64(len(h.registers))
+	sum := 0.0
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Pow(2, -float64(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	alpha := 0.7213 / (1 + 1.079/m)
+	estimate := alpha * m * m / sum
+	// Use linear counting for small cardinalities.
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return math.Round(estimate)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func cardinalityRows(name string, series int) []*crateRow {
+	rows := make([]*crateRow, 0, series)
+	for i := 0; i < series; i++ {
+		metric := model.Metric{"__name__": model.LabelValue(name), "id": model.LabelValue(fmt.Sprint(i))}
+		rows = append(rows, &crateRow{labels: metric, labelsHash: metric.Fingerprint().String()})
+	}
+	return rows
+}
+
+func TestCardinalityTrackerExact(t *testing.T) {
+	tracker := newCardinalityTracker(&cardinalityConfig{Mode: "exact", ActiveWindow: model.Duration(time.Hour)})
+	now := time.Unix(0, 0)
+	tracker.now = func() time.Time { return now }
+
+	rows := append(cardinalityRows("a", 3), cardinalityRows("b", 5)...)
+	result := tracker.filter(&crateWriteRequest{rows: rows})
+	require.Len(t, result.rows, 8)
+	// Writing the same series again does not increase the count.
+	tracker.filter(&crateWriteRequest{rows: rows})
+	require.Equal(t, map[string]int{"a": 3, "b": 5}, tracker.counts())
+
+	// Series fall out of the window when they are not written anymore.
+	now = now.Add(30 * time.Minute)
+	tracker.filter(&crateWriteRequest{rows: cardinalityRows("a", 3)})
+	now = now.Add(31 * time.Minute)
+	require.Equal(t, map[string]int{"a": 3}, tracker.counts())
+}
+
+func TestCardinalityTrackerExpireInterval(t *testing.T) {
+	tracker := newCardinalityTracker(&cardinalityConfig{Mode: "exact", ActiveWindow: model.Duration(16 * time.Minute)})
+	now := time.Unix(0, 0)
+	tracker.now = func() time.Time { return now }
+	tracker.filter(&crateWriteRequest{rows: cardinalityRows("a", 3)})
+	now = now.Add(15*time.Minute + 30*time.Second)
+	tracker.filter(&crateWriteRequest{rows: cardinalityRows("b", 2)})
+
+	// Series are only expired once per 1/16 of the window.
+	now = now.Add(40 * time.Second)
+	require.Equal(t, map[string]int{"a": 3, "b": 2}, tracker.counts())
+	now = now.Add(30 * time.Second)
+	require.Equal(t, map[string]int{"b": 2}, tracker.counts())
+}
+
+func TestCardinalityTrackerLimits(t *testing.T) {
+	tracker := newCardinalityTracker(&cardinalityConfig{
+		Mode:               "exact",
+		ActiveWindow:       model.Duration(time.Hour),
+		MaxSeriesPerMetric: 4,
+		MaxSeriesTotal:     6,
+	})
+
+	result := tracker.filter(&crateWriteRequest{rows: cardinalityRows("a", 5)})
+	require.Len(t, result.rows, 4)
+	result = tracker.filter(&crateWriteRequest{rows: cardinalityRows("b", 5)})
+	require.Len(t, result.rows, 2)
+	// Known series are still accepted when the limits are reached.
+	result = tracker.filter(&crateWriteRequest{rows: cardinalityRows("a", 5)})
+	require.Len(t, result.rows, 4)
+	require.Equal(t, map[string]int{"a": 4, "b": 2}, tracker.counts())
+}
+
+func TestCardinalityTrackerHyperLogLog(t *testing.T) {
+	seed := hllSeed
+	hllSeed = 42
+	defer func() { hllSeed = seed }()
+	tracker := newCardinalityTracker(&cardinalityConfig{Mode: "hyperloglog", ActiveWindow: model.Duration(time.Hour)})
+	tracker.filter(&crateWriteRequest{rows: cardinalityRows("a", 10000)})
+	tracker.filter(&crateWriteRequest{rows: cardinalityRows("b", 100)})
+	counts := tracker.counts()
+	require.InEpsilon(t, 10000, counts["a"], 0.05)
+	require.InEpsilon(t, 100, counts["b"], 0.05)
+}
+
+func TestCardinalityConfigValidate(t *testing.T) {
+	conf := &cardinalityConfig{Mode: "hyperloglog", ActiveWindow: model.Duration(time.Hour), MaxSeriesTotal: 1}
+	require.ErrorContains(t, conf.validate(), "series limits require cardinality mode")
+	conf = &cardinalityConfig{Mode: "foo", ActiveWindow: model.Duration(time.Hour)}
+	require.ErrorContains(t, conf.validate(), "unknown cardinality mode")
+}
+
+func TestCardinalityStatusHandler(t *testing.T) {
+	tracker := newCardinalityTracker(&cardinalityConfig{Mode: "exact", ActiveWindow: model.Duration(time.Hour)})
+	rows := append(cardinalityRows("a", 3), cardinalityRows("b", 5)...)
+	rows = append(rows, cardinalityRows("c", 1)...)
+	tracker.filter(&crateWriteRequest{rows: rows})
+
+	rec := httptest.NewRecorder()
+	tracker.handleStatus(rec, httptest.NewRequest("GET", "/api/v1/status/cardinality?limit=2", nil))
+	require.Equal(t, 200, rec.Code)
+
+	status := &cardinalityStatus{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), status))
+	require.Equal(t, 9, status.Total)
+	require.Equal(t, []cardinalityEntry{{Name: "b", Series: 5}, {Name: "a", Series: 3}}, status.Top)
+
+	rec = httptest.NewRecorder()
+	tracker.handleStatus(rec, httptest.NewRequest("GET", "/api/v1/status/cardinality?limit=foo", nil))
+	require.Equal(t, 400, rec.Code)
+}
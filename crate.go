@@ -2,17 +2,22 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
 	"github.com/jackc/pgtype"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/prometheus/common/model"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
+const crateWriteStatementName = "write_statement"
+
 const crateWriteStatement = `INSERT INTO metrics ("labels", "labels_hash", "timestamp", "value", "valueRaw") VALUES ($1, $2, $3, $4, $5) ON CONFLICT DO NOTHING`
 
 type crateRow struct {
@@ -35,17 +40,54 @@ type crateReadResponse struct {
 	rows []*crateRow
 }
 
+// Bounds of the delay between attempts to create the connection pools.
+const (
+	minPoolBackoff = 1 * time.Second
+	maxPoolBackoff = 30 * time.Second
+)
+
 type crateEndpoint struct {
+	name          string
 	poolConf      *pgxpool.Config
 	readPoolSize  int
 	writePoolSize int
 	readTimeout   time.Duration
 	writeTimeout  time.Duration
-	readPool      *pgxpool.Pool
-	writePool     *pgxpool.Pool
+	now           func() time.Time
+
+	// The connection pools are created lazily, and guarded by `mtx`.
+	mtx         sync.Mutex
+	readPool    *pgxpool.Pool
+	writePool   *pgxpool.Pool
+	closed      bool
+	backoff     time.Duration
+	nextAttempt time.Time
+	lastErr     error
 }
 
-func newCrateEndpoint(ep *endpointConfig) *crateEndpoint {
+// configureTLS enforces TLS for all hosts of the connection settings. With the
+// default `sslmode=prefer`, pgx would fall back to plaintext connections when
+// the TLS handshake fails, defeating the verification of the certificates.
+func configureTLS(ep *endpointConfig, connConfig *pgx.ConnConfig) {
+	connConfig.TLSConfig = newEndpointTLS(ep, connConfig.Host).config()
+	type address struct {
+		host string
+		port uint16
+	}
+	seen := map[address]bool{{connConfig.Host, connConfig.Port}: true}
+	fallbacks := []*pgconn.FallbackConfig{}
+	for _, fb := range connConfig.Fallbacks {
+		if seen[address{fb.Host, fb.Port}] {
+			continue
+		}
+		seen[address{fb.Host, fb.Port}] = true
+		fb.TLSConfig = newEndpointTLS(ep, fb.Host).config()
+		fallbacks = append(fallbacks, fb)
+	}
+	connConfig.Fallbacks = fallbacks
+}
+
+func newCrateEndpoint(ep *endpointConfig) (*crateEndpoint, error) {
 
 	// pgx4 starts using connection strings exclusively, in both URL and DSN formats.
 	// The single entrypoint to obtain a valid configuration object, is `pgx.ParseConfig`,
@@ -70,15 +112,25 @@ func newCrateEndpoint(ep *endpointConfig) *crateEndpoint {
 	// Create configuration object from DSN-style connection string.
 	poolConf, err := pgxpool.ParseConfig(ep.toDSN())
 	if err != nil {
-		return nil
+		return nil, fmt.Errorf("invalid connection settings for endpoint %s: %v", ep.toString(), err)
+	}
+
+	// Settings which are not part of a full connection string.
+	if ep.ConnectionString != "" {
+		if ep.MaxConnections != 0 {
+			poolConf.MaxConns = int32(ep.MaxConnections)
+		}
+		if ep.ConnectTimeout != 0 {
+			poolConf.ConnConfig.ConnectTimeout = time.Duration(ep.ConnectTimeout) * time.Second
+		}
 	}
 
+	// Create spans for connects, acquires and queries.
+	poolConf.ConnConfig.Tracer = pgxTracer{}
+
 	// Configure TLS settings.
 	if ep.EnableTLS {
-		poolConf.ConnConfig.TLSConfig = &tls.Config{
-			ServerName:         ep.Host,
-			InsecureSkipVerify: ep.AllowInsecureTLS,
-		}
+		configureTLS(ep, poolConf.ConnConfig)
 	}
 
 	// pgx v4
@@ -96,60 +148,158 @@ func newCrateEndpoint(ep *endpointConfig) *crateEndpoint {
 			}
 		}
 
-		_, err := conn.Prepare(ctx, "write_statement", crateWriteStatement)
+		_, err := conn.Prepare(ctx, crateWriteStatementName, crateWriteStatement)
 		if err != nil {
 			return fmt.Errorf("error preparing write statement: %v", err)
 		}
 		return err
 	}
 	return &crateEndpoint{
+		name:          ep.toString(),
 		poolConf:      poolConf,
 		readPoolSize:  ep.ReadPoolSize,
 		writePoolSize: ep.WritePoolSize,
 		readTimeout:   time.Duration(ep.ReadTimeout) * time.Second,
 		writeTimeout:  time.Duration(ep.WriteTimeout) * time.Second,
-	}
+		now:           time.Now,
+	}, nil
 }
 
 func (c *crateEndpoint) endpoint() endpoint.Endpoint {
 
-	// Initialize connection pools lazily here instead of in `newCrateEndpoint()`,
-	// so that the adapter does not crash on startup if the endpoint is unavailable.
 	return func(ctx context.Context, request interface{}) (response interface{}, err error) {
 
-		// Initialize database connection pools.
-		err = c.createPools(ctx)
-
 		// Dispatch by request type.
+		start := time.Now()
+		retry := retryAttempt(ctx) > 1
 		switch r := request.(type) {
 		case *crateWriteRequest:
-			return nil, c.write(ctx, r)
+			if retry {
+				metrics.observeRetry(c.name, "write")
+			}
+			err = c.write(ctx, r)
+			metrics.observeCrate(c.name, "write", time.Since(start), err)
+			return nil, err
 		case *crateReadRequest:
-			return c.read(ctx, r)
+			if retry {
+				metrics.observeRetry(c.name, "read")
+			}
+			response, err = c.read(ctx, r)
+			metrics.observeCrate(c.name, "read", time.Since(start), err)
+			return response, err
 		default:
 			panic("unknown request type")
 		}
 	}
 }
 
-func (c *crateEndpoint) createPools(ctx context.Context) (err error) {
+// Initialize connection pools lazily here instead of in `newCrateEndpoint()`,
+// so that the adapter does not crash on startup if the endpoint is unavailable.
+// Creating a pool does not connect yet, so this only fails on invalid pool
+// settings, after which creating the pools is retried with exponential backoff.
+func (c *crateEndpoint) pools(ctx context.Context) (readPool *pgxpool.Pool, writePool *pgxpool.Pool, err error) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	if c.closed {
+		return nil, nil, fmt.Errorf("endpoint %s is closed", c.name)
+	}
+	if c.readPool != nil && c.writePool != nil {
+		return c.readPool, c.writePool, nil
+	}
+	now := c.now()
+	if now.Before(c.nextAttempt) {
+		return nil, nil, fmt.Errorf("%v (retrying in %v)", c.lastErr, c.nextAttempt.Sub(now).Round(time.Millisecond))
+	}
 
 	// Initialize two connection pools, one for read/write each.
 	if c.readPool == nil {
 		c.readPool, err = createPoolWithPoolSize(ctx, c.poolConf.Copy(), c.readPoolSize)
-		if err != nil {
-			return err
-		}
 	}
-	if c.writePool == nil {
+	if err == nil && c.writePool == nil {
 		c.writePool, err = createPoolWithPoolSize(ctx, c.poolConf.Copy(), c.writePoolSize)
-		if err != nil {
-			return err
-		}
+	}
+	if err != nil {
+		c.backoff = min(max(2*c.backoff, minPoolBackoff), maxPoolBackoff)
+		c.nextAttempt = now.Add(c.backoff)
+		c.lastErr = err
+		logger.Warn("Failed to create connection pools", "endpoint", c.name, "err", err, "backoff", c.backoff)
+		return nil, nil, err
+	}
+	c.backoff = 0
+	c.nextAttempt = time.Time{}
+	return c.readPool, c.writePool, nil
+}
+
+func (c *crateEndpoint) createPools(ctx context.Context) error {
+	_, _, err := c.pools(ctx)
+	return err
+}
+
+// Return the connection pools if they have been created already.
+func (c *crateEndpoint) currentPools() (readPool *pgxpool.Pool, writePool *pgxpool.Pool) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.readPool, c.writePool
+}
+
+// Close both connection pools, so that they are created again on the next
+// request, establishing new connections. The old pools are closed in the
+// background, as closing them waits for acquired connections to be released.
+func (c *crateEndpoint) reconnect() {
+	c.mtx.Lock()
+	readPool, writePool := c.takePools()
+	c.backoff = 0
+	c.nextAttempt = time.Time{}
+	c.mtx.Unlock()
+	go closePools(readPool, writePool)
+}
+
+// Check that a connection can be acquired, and that the metrics table exists.
+func (c *crateEndpoint) checkReady(ctx context.Context) error {
+	readPool, _, err := c.pools(ctx)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.readTimeout)
+	defer cancel()
+	conn, err := readPool.Acquire(ctx)
+	if err != nil {
+		return fmt.Errorf("error acquiring connection: %v", err)
+	}
+	defer conn.Release()
+	if _, err := conn.Exec(ctx, "SELECT * FROM metrics LIMIT 0"); err != nil {
+		return fmt.Errorf("error checking metrics table: %v", err)
 	}
 	return nil
 }
 
+// Close both connection pools, waiting for acquired connections to be released.
+// Afterwards, the endpoint can not be used anymore.
+func (c *crateEndpoint) close() {
+	c.mtx.Lock()
+	readPool, writePool := c.takePools()
+	c.closed = true
+	c.mtx.Unlock()
+	closePools(readPool, writePool)
+}
+
+// Remove the connection pools from the endpoint, so that they can be closed
+// without holding the lock. The caller must hold the lock.
+func (c *crateEndpoint) takePools() (readPool *pgxpool.Pool, writePool *pgxpool.Pool) {
+	readPool, writePool = c.readPool, c.writePool
+	c.readPool, c.writePool = nil, nil
+	return readPool, writePool
+}
+
+func closePools(pools ...*pgxpool.Pool) {
+	for _, pool := range pools {
+		if pool != nil {
+			pool.Close()
+		}
+	}
+}
+
 func createPool(ctx context.Context, poolConf *pgxpool.Config) (pool *pgxpool.Pool, err error) {
 	pool, err = pgxpool.NewWithConfig(ctx, poolConf)
 	if err != nil {
@@ -166,22 +316,19 @@ func createPoolWithPoolSize(ctx context.Context, poolConf *pgxpool.Config, maxCo
 	return createPool(ctx, poolConf)
 }
 
-func (c crateEndpoint) write(ctx context.Context, r *crateWriteRequest) error {
-	batch := &pgx.Batch{}
-	for _, a := range r.rows {
-		batch.Queue(
-			"write_statement",
-			a.labels,
-			a.labelsHash,
-			// TODO: Find non-string way of encoding timestamps.
-			//       Maybe it is more efficient to submit timestamp as Unixtime,
-			//       instead of converting it into a string?
-			a.timestamp.Format("2006-01-02 15:04:05.000-07"),
-			a.value,
-			a.valueRaw,
-		)
+func (c *crateEndpoint) write(ctx context.Context, r *crateWriteRequest) (err error) {
+	ctx, span := startSpan(ctx, "crate write", trace.WithAttributes(
+		attribute.String("cratedb.endpoint", c.name),
+		attribute.Int("cratedb.rows", len(r.rows)),
+	))
+	defer func() { endSpan(span, err) }()
+
+	_, writePool, err := c.pools(ctx)
+	if err != nil {
+		return err
 	}
 
+
 	// pgx4 implements query timeouts using context cancellation.
 
 	// In production applications, it is *always* preferred to have timeouts for all queries:
@@ -214,28 +361,100 @@ func (c crateEndpoint) write(ctx context.Context, r *crateWriteRequest) error {
 	//
 	// -- https://github.com/jackc/pgx/blob/v3.6.2/batch.go#L58-L79
 	//
-	ctx, _ = context.WithTimeout(ctx, c.writeTimeout)
+	return execWriteBatch(ctx, r.rows, c.writeTimeout, func(ctx context.Context, rows []*crateRow) pgx.BatchResults {
+		batch := &pgx.Batch{}
+		for _, a := range rows {
+			batch.Queue(crateWriteStatementName, writeArguments(a)...)
+		}
+		return writePool.SendBatch(ctx, batch)
+	})
+}
 
-	batchResults := c.writePool.SendBatch(ctx, batch)
-	var qerr error
-	if qerr != nil {
-		return fmt.Errorf("error executing write batch: %v", qerr)
+func writeArguments(row *crateRow) []any {
+	return []any{
+		row.labels,
+		row.labelsHash,
+		// TODO: Find non-string way of encoding timestamps.
+		//       Maybe it is more efficient to submit timestamp as Unixtime,
+		//       instead of converting it into a string?
+		row.timestamp.Format("2006-01-02 15:04:05.000-07"),
+		row.value,
+		row.valueRaw,
 	}
+}
 
-	err := batchResults.Close()
-	if err != nil {
-		return fmt.Errorf("error closing write batch: %v", err)
+// Write rows in batches using `send`, reading the result of every row, so that
+// partial failures are not lost.
+//
+// Errors of batch results are sticky: after the first failed row, the server
+// skips the remaining rows of the batch, and pgx returns the same error for
+// them. When the failure is permanent, like invalid data, the remaining rows
+// are therefore sent again as a new batch, until no permanent failure remains,
+// so that only the rows which actually fail are counted. Every batch gets its
+// own `timeout`, so that many failed rows do not exhaust the timeout of the
+// first batch. Transient failures, like connection errors, fail the remaining
+// rows as well, which are retried as a whole.
+func execWriteBatch(ctx context.Context, rows []*crateRow, timeout time.Duration, send func(context.Context, []*crateRow) pgx.BatchResults) error {
+	writeErr := &crateWriteError{rows: len(rows)}
+	for len(rows) > 0 {
+		batchCtx, cancel := context.WithTimeout(ctx, timeout)
+		failedAt, err := readWriteBatch(send(batchCtx, rows), len(rows))
+		cancel()
+		if failedAt < 0 {
+			if err != nil && writeErr.failed == 0 {
+				return err
+			}
+			break
+		}
+		writeErr.add(err)
+		if permanent, _ := classifyError(err); !permanent {
+			for range rows[failedAt+1:] {
+				writeErr.add(err)
+			}
+			break
+		}
+		rows = rows[failedAt+1:]
+	}
+	if writeErr.failed > 0 {
+		return writeErr
 	}
 	return nil
 }
 
-func (c crateEndpoint) read(ctx context.Context, r *crateReadRequest) (*crateReadResponse, error) {
+// Read the results of a write batch up to the first failed row, returning its
+// index and error. Without a failed row, the index is -1.
+func readWriteBatch(batchResults pgx.BatchResults, rows int) (int, error) {
+	failedAt := -1
+	var rowErr error
+	for i := 0; i < rows; i++ {
+		if _, err := batchResults.Exec(); err != nil {
+			failedAt, rowErr = i, err
+			break
+		}
+	}
+	// Close the batch before sending further rows, which releases its
+	// connection to the pool.
+	if err := batchResults.Close(); err != nil && rowErr == nil {
+		return -1, fmt.Errorf("error closing write batch: %v", err)
+	}
+	return failedAt, rowErr
+}
+
+func (c *crateEndpoint) read(ctx context.Context, r *crateReadRequest) (_ *crateReadResponse, err error) {
+	ctx, span := startSpan(ctx, "crate read", trace.WithAttributes(attribute.String("cratedb.endpoint", c.name)))
+	defer func() { endSpan(span, err) }()
+
 	// pgx4 implements query timeouts using context cancellation.
 	// See `write` function for more details.
-	ctx, _ = context.WithTimeout(ctx, c.readTimeout)
-	rows, err := c.readPool.Query(ctx, r.stmt)
+	ctx, cancel := context.WithTimeout(ctx, c.readTimeout)
+	defer cancel()
+	readPool, _, err := c.pools(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := readPool.Query(ctx, r.stmt)
 	if err != nil {
-		return nil, fmt.Errorf("error executing read request query: %v", err)
+		return nil, fmt.Errorf("error executing read request query: %w", err)
 	}
 	defer rows.Close()
 
@@ -251,7 +470,7 @@ func (c crateEndpoint) read(ctx context.Context, r *crateReadRequest) (*crateRea
 		resp.rows = append(resp.rows, rr)
 	}
 	if err := rows.Err(); err != nil {
-		return nil, fmt.Errorf("error iterating through read request rows: %v", err)
+		return nil, fmt.Errorf("error iterating through read request rows: %w", err)
 	}
 	return resp, nil
 }
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// Reasons for failed writes, used as `reason` label of the dropped samples metric.
+const (
+	reasonInvalidData         = "invalid_data"
+	reasonConstraintViolation = "constraint_violation"
+	reasonSchema              = "schema"
+	reasonConnection          = "connection"
+	reasonTimeout             = "timeout"
+	reasonDatabase            = "database"
+)
+
+// Classify an error returned by CrateDB. Permanent errors will fail again when
+// retrying the same request, like schema errors or bad data. Retriable errors
+// are transient, like connection errors and timeouts.
+func classifyError(err error) (permanent bool, reason string) {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) {
+		if len(pgErr.Code) < 2 {
+			return false, reasonDatabase
+		}
+		switch pgErr.Code[:2] {
+		case "22":
+			// Data exception, like a value which does not match the column type.
+			return true, reasonInvalidData
+		case "23":
+			// Integrity constraint violation.
+			return true, reasonConstraintViolation
+		case "42":
+			// Syntax error or access rule violation, like an unknown table.
+			return true, reasonSchema
+		case "08":
+			// Connection exception.
+			return false, reasonConnection
+		case "57":
+			// Operator intervention, like a canceled query or a shutdown.
+			return false, reasonTimeout
+		default:
+			return false, reasonDatabase
+		}
+	}
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) || pgconn.Timeout(err) {
+		return false, reasonTimeout
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) || pgconn.SafeToRetry(err) {
+		return false, reasonConnection
+	}
+	return false, reasonDatabase
+}
+
+// crateWriteError is returned when some or all rows of a write request could
+// not be written. It is permanent when all failures are permanent.
+type crateWriteError struct {
+	rows      int
+	failed    int
+	permanent bool
+	reason    string
+	err       error
+}
+
+func (e *crateWriteError) add(err error) {
+	permanent, reason := classifyError(err)
+	if e.failed == 0 {
+		e.err = err
+		e.reason = reason
+		e.permanent = permanent
+	} else if !permanent {
+		e.permanent = false
+	}
+	e.failed++
+}
+
+func (e *crateWriteError) Error() string {
+	if e.failed == e.rows {
+		return fmt.Sprintf("error executing write batch: %v", e.err)
+	}
+	return fmt.Sprintf("error executing write batch: %d of %d rows failed: %v", e.failed, e.rows, e.err)
+}
+
+func (e *crateWriteError) Unwrap() error {
+	return e.err
+}
+
+// Find the write error, also within errors of the retrying load balancer.
+func asWriteError(err error) (*crateWriteError, bool) {
+	var retryErr lb.RetryError
+	if errors.As(err, &retryErr) {
+		err = retryErr.Final
+	}
+	var writeErr *crateWriteError
+	ok := errors.As(err, &writeErr)
+	return writeErr, ok
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassifyError(t *testing.T) {
+	for _, tc := range []struct {
+		err       error
+		permanent bool
+		reason    string
+	}{
+		{&pgconn.PgError{Code: "22P02"}, true, reasonInvalidData},
+		{fmt.Errorf("wrapped: %w", &pgconn.PgError{Code: "23505"}), true, reasonConstraintViolation},
+		{&pgconn.PgError{Code: "42P01"}, true, reasonSchema},
+		{&pgconn.PgError{Code: "08006"}, false, reasonConnection},
+		{&pgconn.PgError{Code: "57014"}, false, reasonTimeout},
+		{&pgconn.PgError{Code: "XX000"}, false, reasonDatabase},
+		{context.DeadlineExceeded, false, reasonTimeout},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, false, reasonConnection},
+		{errors.New("unknown"), false, reasonDatabase},
+	} {
+		permanent, reason := classifyError(tc.err)
+		require.Equal(t, tc.permanent, permanent, "%v", tc.err)
+		require.Equal(t, tc.reason, reason, "%v", tc.err)
+	}
+}
+
+func TestCrateWriteError(t *testing.T) {
+	writeErr := &crateWriteError{rows: 3}
+	writeErr.add(&pgconn.PgError{Severity: "ERROR", Code: "22P02", Message: "Cannot cast value"})
+	writeErr.add(&pgconn.PgError{Severity: "ERROR", Code: "22P02", Message: "Cannot cast value"})
+	require.True(t, writeErr.permanent)
+	require.Equal(t, reasonInvalidData, writeErr.reason)
+	require.EqualError(t, writeErr, "error executing write batch: 2 of 3 rows failed: ERROR: Cannot cast value (SQLSTATE 22P02)")
+
+	// A single retriable failure makes retrying worthwhile.
+	writeErr.add(context.DeadlineExceeded)
+	require.False(t, writeErr.permanent)
+	require.EqualError(t, writeErr, "error executing write batch: ERROR: Cannot cast value (SQLSTATE 22P02)")
+}
+
+func TestHandleWriteErrors(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	data, err := (&prompb.WriteRequest{}).Marshal()
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		err  error
+		code int
+	}{
+		{&crateWriteError{rows: 5, failed: 5, permanent: true, reason: reasonSchema}, http.StatusBadRequest},
+		{lb.RetryError{Final: &crateWriteError{rows: 5, failed: 5, permanent: true, reason: reasonSchema}}, http.StatusBadRequest},
+		{&crateWriteError{rows: 5, failed: 5, reason: reasonConnection}, http.StatusInternalServerError},
+		{errors.New("error opening connection"), http.StatusInternalServerError},
+	} {
+		ca := &crateDbPrometheusAdapter{
+			ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+				return nil, tc.err
+			},
+		}
+		rec := httptest.NewRecorder()
+		ca.handleWrite(rec, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+		require.Equal(t, tc.code, rec.Code, "%v", tc.err)
+	}
+	require.Equal(t, float64(10), testutil.ToFloat64(metrics.samplesDropped.WithLabelValues(reasonSchema)))
+	require.Equal(t, float64(0), testutil.ToFloat64(metrics.samplesDropped.WithLabelValues(reasonConnection)))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// poolStatDesc describes a metric derived from `pgxpool.Stat`.
+type poolStatDesc struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	value     func(s *pgxpool.Stat) float64
+}
+
+func newPoolStatDesc(name string, help string, valueType prometheus.ValueType, value func(s *pgxpool.Stat) float64) poolStatDesc {
+	return poolStatDesc{
+		desc: prometheus.NewDesc(
+			metrics.prefix+"pool_"+name,
+			help,
+			[]string{"endpoint", "pool"}, nil,
+		),
+		valueType: valueType,
+		value:     value,
+	}
+}
+
+// poolCollector exports the statistics of the read and write connection pools
+// of all CrateDB endpoints.
+type poolCollector struct {
+	endpoints []*crateEndpoint
+	descs     []poolStatDesc
+}
+
+func newPoolCollector(endpoints []*crateEndpoint) *poolCollector {
+	return &poolCollector{
+		endpoints: endpoints,
+		descs: []poolStatDesc{
+			newPoolStatDesc("acquired_connections", "Number of currently acquired connections in the pool.",
+				prometheus.GaugeValue, func(s *pgxpool.Stat) float64 { return float64(s.AcquiredConns()) }),
+			newPoolStatDesc("idle_connections", "Number of currently idle connections in the pool.",
+				prometheus.GaugeValue, func(s *pgxpool.Stat) float64 { return float64(s.IdleConns()) }),
+			newPoolStatDesc("constructing_connections", "Number of connections with construction in progress in the pool.",
+				prometheus.GaugeValue, func(s *pgxpool.Stat) float64 { return float64(s.ConstructingConns()) }),
+			newPoolStatDesc("total_connections", "Total number of connections currently in the pool.",
+				prometheus.GaugeValue, func(s *pgxpool.Stat) float64 { return float64(s.TotalConns()) }),
+			newPoolStatDesc("max_connections", "Maximum size of the pool.",
+				prometheus.GaugeValue, func(s *pgxpool.Stat) float64 { return float64(s.MaxConns()) }),
+			newPoolStatDesc("acquires_total", "Number of successful acquires from the pool.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.AcquireCount()) }),
+			newPoolStatDesc("acquire_duration_seconds_total", "Total duration of all successful acquires from the pool.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return s.AcquireDuration().Seconds() }),
+			newPoolStatDesc("empty_acquires_total", "Number of successful acquires that waited for a connection because the pool was empty.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.EmptyAcquireCount()) }),
+			newPoolStatDesc("empty_acquire_wait_seconds_total", "Total time waited for a connection because the pool was empty.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return s.EmptyAcquireWaitTime().Seconds() }),
+			newPoolStatDesc("canceled_acquires_total", "Number of acquires from the pool that were canceled by a context.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.CanceledAcquireCount()) }),
+			newPoolStatDesc("new_connections_total", "Number of new connections opened by the pool.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.NewConnsCount()) }),
+			newPoolStatDesc("max_lifetime_destroys_total", "Number of connections destroyed because they exceeded their maximum lifetime.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.MaxLifetimeDestroyCount()) }),
+			newPoolStatDesc("max_idle_destroys_total", "Number of connections destroyed because they exceeded their maximum idle time.",
+				prometheus.CounterValue, func(s *pgxpool.Stat) float64 { return float64(s.MaxIdleDestroyCount()) }),
+		},
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (p *poolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range p.descs {
+		ch <- d.desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (p *poolCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, ep := range p.endpoints {
+		// Pools are created lazily, so they may not exist yet.
+		readPool, writePool := ep.currentPools()
+		pools := map[string]*pgxpool.Pool{"read": readPool, "write": writePool}
+		for kind, pool := range pools {
+			if pool == nil {
+				continue
+			}
+			stat := pool.Stat()
+			for _, d := range p.descs {
+				ch <- prometheus.MustNewConstMetric(d.desc, d.valueType, d.value(stat), ep.name, kind)
+			}
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPoolCollector(t *testing.T) {
+	conf := builtinConfig()
+	conf.Endpoints[0].ReadPoolSize = 11
+	conf.Endpoints[0].WritePoolSize = 22
+	endpoint, err := newCrateEndpoint(&conf.Endpoints[0])
+	require.NoError(t, err)
+	collector := newPoolCollector([]*crateEndpoint{endpoint})
+
+	// Nothing is reported before the pools have been created.
+	require.Equal(t, 0, testutil.CollectAndCount(collector))
+
+	endpoint.createPools(context.Background())
+	require.Equal(t, 2*len(collector.descs), testutil.CollectAndCount(collector))
+
+	registry := prometheus.NewPedanticRegistry()
+	registry.MustRegister(collector)
+	families, err := registry.Gather()
+	require.NoError(t, err)
+
+	maxConns := map[string]float64{}
+	for _, family := range families {
+		if family.GetName() != "cratedb_prometheus_adapter_pool_max_connections" {
+			continue
+		}
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			require.Equal(t, "crate@localhost:5432/", labels["endpoint"])
+			maxConns[labels["pool"]] = metric.GetGauge().GetValue()
+		}
+	}
+	require.Equal(t, map[string]float64{"read": 11, "write": 22}, maxConns)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// endpointTLS builds TLS client configurations for CrateDB connections.
+// The CA bundle and the client certificate are loaded lazily on each new
+// connection, and reloaded when they have been rotated on disk.
+type endpointTLS struct {
+	serverName string
+	insecure   bool
+	caFile     string
+	certFile   string
+	keyFile    string
+
+	mtx         sync.Mutex
+	caPool      *x509.CertPool
+	caModTime   time.Time
+	cert        *tls.Certificate
+	certModTime time.Time
+}
+
+func newEndpointTLS(ep *endpointConfig, host string) *endpointTLS {
+	serverName := ep.TLSServerName
+	if serverName == "" {
+		serverName = host
+	}
+	return &endpointTLS{
+		serverName: serverName,
+		insecure:   ep.AllowInsecureTLS,
+		caFile:     ep.TLSCAFile,
+		certFile:   ep.TLSCertFile,
+		keyFile:    ep.TLSKeyFile,
+	}
+}
+
+func (t *endpointTLS) config() *tls.Config {
+	conf := &tls.Config{
+		ServerName:         t.serverName,
+		InsecureSkipVerify: t.insecure,
+	}
+	if t.certFile != "" {
+		conf.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return t.certificate()
+		}
+	}
+	if t.caFile != "" && !t.insecure {
+		// Verify the server certificate against the current CA bundle manually,
+		// because `RootCAs` can not be swapped after the fact.
+		conf.InsecureSkipVerify = true
+		conf.VerifyConnection = t.verifyConnection
+	}
+	return conf
+}
+
+func (t *endpointTLS) verifyConnection(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return fmt.Errorf("CrateDB did not present a TLS certificate")
+	}
+	roots, err := t.rootCAs()
+	if err != nil {
+		return err
+	}
+	opts := x509.VerifyOptions{
+		DNSName:       t.serverName,
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range cs.PeerCertificates[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	_, err = cs.PeerCertificates[0].Verify(opts)
+	return err
+}
+
+func (t *endpointTLS) rootCAs() (*x509.CertPool, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	info, err := os.Stat(t.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS CA file: %v", err)
+	}
+	if t.caPool != nil && info.ModTime().Equal(t.caModTime) {
+		return t.caPool, nil
+	}
+	content, err := os.ReadFile(t.caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading TLS CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificates found in TLS CA file %q", t.caFile)
+	}
+	t.caPool = pool
+	t.caModTime = info.ModTime()
+	return pool, nil
+}
+
+func (t *endpointTLS) certificate() (*tls.Certificate, error) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+
+	modTime := time.Time{}
+	for _, filename := range []string{t.certFile, t.keyFile} {
+		info, err := os.Stat(filename)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS client certificate: %v", err)
+		}
+		if info.ModTime().After(modTime) {
+			modTime = info.ModTime()
+		}
+	}
+	if t.cert != nil && modTime.Equal(t.certModTime) {
+		return t.cert, nil
+	}
+	cert, err := tls.LoadX509KeyPair(t.certFile, t.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("error loading TLS client certificate: %v", err)
+	}
+	t.cert = &cert
+	t.certModTime = modTime
+	return t.cert, nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndpointTLSHandshake(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "server")
+	writeCertificate(t, dir, "client")
+	writeCertificate(t, dir, "other")
+
+	serverCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key"))
+	require.NoError(t, err)
+	clientPEM, err := os.ReadFile(filepath.Join(dir, "client.crt"))
+	require.NoError(t, err)
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientPEM)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	})
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake()
+			conn.Close()
+		}
+	}()
+
+	handshake := func(ep *endpointConfig) error {
+		conn, err := tls.Dial("tcp", l.Addr().String(), newEndpointTLS(ep, ep.Host).config())
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		// With TLS 1.3, client certificate errors are reported on the first read.
+		_, err = conn.Read(make([]byte, 1))
+		if err != nil && err.Error() == "EOF" {
+			return nil
+		}
+		return err
+	}
+
+	ep := &endpointConfig{
+		Host:          "localhost",
+		EnableTLS:     true,
+		TLSServerName: "127.0.0.1",
+		TLSCAFile:     filepath.Join(dir, "server.crt"),
+		TLSCertFile:   filepath.Join(dir, "client.crt"),
+		TLSKeyFile:    filepath.Join(dir, "client.key"),
+	}
+	require.NoError(t, handshake(ep))
+
+	// The server certificate is not signed by the configured CA.
+	wrongCA := *ep
+	wrongCA.TLSCAFile = filepath.Join(dir, "other.crt")
+	require.ErrorContains(t, handshake(&wrongCA), "certificate signed by unknown authority")
+
+	// The server does not accept the client certificate.
+	wrongCert := *ep
+	wrongCert.TLSCertFile = filepath.Join(dir, "other.crt")
+	wrongCert.TLSKeyFile = filepath.Join(dir, "other.key")
+	require.Error(t, handshake(&wrongCert))
+}
+
+func TestEndpointTLSReload(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "client")
+	endpointTLS := newEndpointTLS(&endpointConfig{
+		Host:        "localhost",
+		EnableTLS:   true,
+		TLSCAFile:   filepath.Join(dir, "client.crt"),
+		TLSCertFile: filepath.Join(dir, "client.crt"),
+		TLSKeyFile:  filepath.Join(dir, "client.key"),
+	}, "localhost")
+
+	first, err := endpointTLS.certificate()
+	require.NoError(t, err)
+	pool, err := endpointTLS.rootCAs()
+	require.NoError(t, err)
+	again, err := endpointTLS.certificate()
+	require.NoError(t, err)
+	require.Same(t, first, again)
+
+	// Rotate the certificate on disk.
+	writeCertificate(t, dir, "client")
+	future := time.Now().Add(time.Minute)
+	for _, name := range []string{"client.crt", "client.key"} {
+		require.NoError(t, os.Chtimes(filepath.Join(dir, name), future, future))
+	}
+	rotated, err := endpointTLS.certificate()
+	require.NoError(t, err)
+	require.NotEqual(t, first.Certificate[0], rotated.Certificate[0])
+	rotatedPool, err := endpointTLS.rootCAs()
+	require.NoError(t, err)
+	require.NotSame(t, pool, rotatedPool)
+}
+
+func TestEndpointConfigValidateTLS(t *testing.T) {
+	ep := &endpointConfig{TLSCAFile: "ca.crt"}
+	require.ErrorContains(t, ep.validateTLS(), "TLS settings require enable_tls")
+	ep = &endpointConfig{EnableTLS: true, TLSCertFile: "client.crt"}
+	require.ErrorContains(t, ep.validateTLS(), "must be configured together")
+	ep = &endpointConfig{EnableTLS: true, TLSCertFile: "client.crt", TLSKeyFile: "client.key"}
+	require.NoError(t, ep.validateTLS())
+}
+
+func TestEndpointTLSNoPlaintextFallback(t *testing.T) {
+	for _, tc := range []struct {
+		ep    *endpointConfig
+		hosts []string
+	}{
+		{&endpointConfig{Host: "localhost", Port: 5432, User: "crate", EnableTLS: true}, []string{"localhost"}},
+		{&endpointConfig{ConnectionString: "postgres://crate@db1:5432,db2:5433/doc?sslmode=prefer", EnableTLS: true}, []string{"db1", "db2"}},
+		{&endpointConfig{ConnectionString: "postgres://crate@db1,db2/doc?sslmode=allow", EnableTLS: true}, []string{"db1", "db2"}},
+		{&endpointConfig{ConnectionString: "postgres://crate@db1/doc?sslmode=disable", EnableTLS: true}, []string{"db1"}},
+	} {
+		endpoint, err := newCrateEndpoint(tc.ep)
+		require.NoError(t, err)
+		connConfig := endpoint.poolConf.ConnConfig
+		require.NotNil(t, connConfig.TLSConfig, tc.ep.toString())
+		require.Equal(t, connConfig.Host, connConfig.TLSConfig.ServerName)
+		hosts := []string{connConfig.Host}
+		for _, fb := range connConfig.Fallbacks {
+			require.NotNil(t, fb.TLSConfig, tc.ep.toString())
+			require.Equal(t, fb.Host, fb.TLSConfig.ServerName)
+			hosts = append(hosts, fb.Host)
+		}
+		// Every host is only tried once, and never without TLS.
+		require.Equal(t, tc.hosts, hosts, tc.ep.toString())
+	}
+}
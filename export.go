@@ -0,0 +1,420 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb"
+)
+
+const (
+	exportFormatOpenMetrics = "openmetrics"
+	exportFormatCSV         = "csv"
+	exportFormatTSDB        = "tsdb"
+)
+
+// exportWriter writes the series of consecutive time windows.
+type exportWriter interface {
+	write(series []*prompb.TimeSeries) error
+	close() error
+}
+
+// Convert parsed series selectors into matchers of remote read queries.
+func toLabelMatchers(matchers []*labels.Matcher) []*prompb.LabelMatcher {
+	result := make([]*prompb.LabelMatcher, 0, len(matchers))
+	for _, m := range matchers {
+		var t prompb.LabelMatcher_Type
+		switch m.Type {
+		case labels.MatchEqual:
+			t = prompb.LabelMatcher_EQ
+		case labels.MatchNotEqual:
+			t = prompb.LabelMatcher_NEQ
+		case labels.MatchRegexp:
+			t = prompb.LabelMatcher_RE
+		case labels.MatchNotRegexp:
+			t = prompb.LabelMatcher_NRE
+		}
+		result = append(result, &prompb.LabelMatcher{Type: t, Name: m.Name, Value: m.Value})
+	}
+	return result
+}
+
+// Key identifying a series by its labels.
+func seriesKey(ts *prompb.TimeSeries) string {
+	var b strings.Builder
+	for _, l := range ts.Labels {
+		b.WriteString(l.Name)
+		b.WriteByte(0xff)
+		b.WriteString(l.Value)
+		b.WriteByte(0xff)
+	}
+	return b.String()
+}
+
+// exporter reads series from CrateDB in time windows, so that only the samples
+// of a single window are held in memory.
+type exporter struct {
+	ep          endpoint.Endpoint
+	matcherSets [][]*prompb.LabelMatcher
+	start       int64
+	end         int64
+	window      int64
+}
+
+func (e *exporter) run(ctx context.Context, w exportWriter) error {
+	for from := e.start; from <= e.end; from += e.window {
+		to := min(from+e.window-1, e.end)
+		series, err := e.query(ctx, from, to)
+		if err != nil {
+			return err
+		}
+		if err := w.write(series); err != nil {
+			return err
+		}
+		logger.Debug("Exported time window", "start", from, "end", to, "series", len(series))
+	}
+	return w.close()
+}
+
+// Read the series of a time window, with both bounds inclusive. A series
+// matching multiple selectors is only returned once.
+func (e *exporter) query(ctx context.Context, from int64, to int64) ([]*prompb.TimeSeries, error) {
+	seen := map[string]bool{}
+	result := []*prompb.TimeSeries{}
+	for _, matchers := range e.matcherSets {
+		stmt, err := queryToSQL(&prompb.Query{StartTimestampMs: from, EndTimestampMs: to, Matchers: matchers})
+		if err != nil {
+			return nil, err
+		}
+		response, err := e.ep(ctx, &crateReadRequest{stmt: stmt})
+		if err != nil {
+			return nil, fmt.Errorf("error reading samples between %d and %d: %w", from, to, err)
+		}
+		for _, ts := range responseToTimeseries(response.(*crateReadResponse)) {
+			key := seriesKey(ts)
+			if !seen[key] {
+				seen[key] = true
+				result = append(result, ts)
+			}
+		}
+	}
+	if len(e.matcherSets) > 1 {
+		sort.Slice(result, func(i, j int) bool {
+			return seriesKey(result[i]) < seriesKey(result[j])
+		})
+	}
+	return result, nil
+}
+
+// Escaping of label values in the OpenMetrics text format.
+var openMetricsEscaper = strings.NewReplacer("\\", `\\`, "\n", `\n`, "\"", `\"`)
+
+// openMetricsWriter writes samples in the OpenMetrics text format, which can be
+// imported using `promtool tsdb create-blocks-from openmetrics`.
+//
+// Metric families must not be interleaved, but the samples of each family are
+// spread across all time windows. The samples of the windows are therefore
+// written into the `spool` file first, and copied to the output grouped by
+// family on close. As the types of metrics are not stored in CrateDB, all
+// families are of the type `unknown`.
+type openMetricsWriter struct {
+	w        *bufio.Writer
+	spool    *os.File
+	buf      *bufio.Writer
+	offset   int64
+	families map[string][]spoolSection
+}
+
+// spoolSection is a range of the spool file.
+type spoolSection struct {
+	offset int64
+	length int64
+}
+
+func newOpenMetricsWriter(w io.Writer, spool *os.File) *openMetricsWriter {
+	return &openMetricsWriter{
+		w:        bufio.NewWriter(w),
+		spool:    spool,
+		buf:      bufio.NewWriter(spool),
+		families: map[string][]spoolSection{},
+	}
+}
+
+func (o *openMetricsWriter) write(series []*prompb.TimeSeries) error {
+	// Group the series of the window by family, keeping their order.
+	var names []string
+	families := map[string][]*prompb.TimeSeries{}
+	for _, ts := range series {
+		var name string
+		for _, l := range ts.Labels {
+			if l.Name == labels.MetricName {
+				name = l.Value
+			}
+		}
+		if families[name] == nil {
+			names = append(names, name)
+		}
+		families[name] = append(families[name], ts)
+	}
+
+	for _, name := range names {
+		section := spoolSection{offset: o.offset}
+		for _, ts := range families[name] {
+			var lbls []string
+			for _, l := range ts.Labels {
+				if l.Name != labels.MetricName {
+					lbls = append(lbls, l.Name+`="`+openMetricsEscaper.Replace(l.Value)+`"`)
+				}
+			}
+			metric := name
+			if len(lbls) > 0 {
+				metric += "{" + strings.Join(lbls, ",") + "}"
+			}
+			for _, s := range ts.Samples {
+				// Timestamps are given in seconds.
+				timestamp := strconv.FormatFloat(float64(s.Timestamp)/1000, 'f', -1, 64)
+				n, err := fmt.Fprintf(o.buf, "%s %s %s\n", metric, strconv.FormatFloat(s.Value, 'g', -1, 64), timestamp)
+				if err != nil {
+					return err
+				}
+				section.length += int64(n)
+			}
+		}
+		o.offset += section.length
+		o.families[name] = append(o.families[name], section)
+	}
+	return nil
+}
+
+func (o *openMetricsWriter) close() error {
+	if err := o.buf.Flush(); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(o.families))
+	for name := range o.families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(o.w, "# TYPE %s unknown\n", name); err != nil {
+			return err
+		}
+		for _, section := range o.families[name] {
+			if _, err := io.Copy(o.w, io.NewSectionReader(o.spool, section.offset, section.length)); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := o.w.WriteString("# EOF\n"); err != nil {
+		return err
+	}
+	return o.w.Flush()
+}
+
+// csvWriter writes one line per sample, with the metric name, the remaining
+// labels as JSON object, the timestamp in RFC 3339 format, and the value.
+type csvWriter struct {
+	w *csv.Writer
+}
+
+func newCSVWriter(w io.Writer) (*csvWriter, error) {
+	c := &csvWriter{w: csv.NewWriter(w)}
+	return c, c.w.Write([]string{"metric", "labels", "timestamp", "value"})
+}
+
+func (c *csvWriter) write(series []*prompb.TimeSeries) error {
+	for _, ts := range series {
+		var name string
+		lbls := map[string]string{}
+		for _, l := range ts.Labels {
+			if l.Name == labels.MetricName {
+				name = l.Value
+			} else {
+				lbls[l.Name] = l.Value
+			}
+		}
+		encoded, err := json.Marshal(lbls)
+		if err != nil {
+			return err
+		}
+		for _, s := range ts.Samples {
+			record := []string{
+				name,
+				string(encoded),
+				time.UnixMilli(s.Timestamp).UTC().Format("2006-01-02T15:04:05.000Z07:00"),
+				strconv.FormatFloat(s.Value, 'g', -1, 64),
+			}
+			if err := c.w.Write(record); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *csvWriter) close() error {
+	c.w.Flush()
+	return c.w.Error()
+}
+
+// tsdbWriter writes one TSDB block per time window into a directory, which can
+// be copied into the data directory of a Prometheus server.
+type tsdbWriter struct {
+	dir    string
+	window int64
+}
+
+func (t *tsdbWriter) write(series []*prompb.TimeSeries) error {
+	if len(series) == 0 {
+		return nil
+	}
+	w, err := tsdb.NewBlockWriter(logger, t.dir, t.window)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	ctx := context.Background()
+	app := w.Appender(ctx)
+	builder := labels.NewScratchBuilder(0)
+	for _, ts := range series {
+		lset := ts.ToLabels(&builder, nil)
+		for _, s := range ts.Samples {
+			if _, err := app.Append(0, lset, s.Timestamp, s.Value); err != nil {
+				app.Rollback()
+				return fmt.Errorf("error appending samples of %s: %v", lset, err)
+			}
+		}
+	}
+	if err := app.Commit(); err != nil {
+		return err
+	}
+	id, err := w.Flush(ctx)
+	if err != nil {
+		return fmt.Errorf("error writing block: %v", err)
+	}
+	logger.Info("Wrote block", "block", id.String())
+	return nil
+}
+
+func (t *tsdbWriter) close() error {
+	return nil
+}
+
+// Run the `export` subcommand, writing samples from CrateDB as OpenMetrics
+// text, CSV, or TSDB blocks.
+func runExport(args []string) error {
+	fs := flag.NewFlagSet("export", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: cratedb-prometheus-adapter export [flags]")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config.file", "", "Path to the CrateDB endpoints configuration file.")
+	start := fs.String("start", "", "Export samples from this time on, as RFC 3339 or Unix timestamp (required).")
+	end := fs.String("end", "", "Export samples up to this time, as RFC 3339 or Unix timestamp (default: now).")
+	format := fs.String("format", exportFormatOpenMetrics, "Output format, either \"openmetrics\", \"csv\" or \"tsdb\".")
+	output := fs.String("output", "-", "Output file, or directory for the \"tsdb\" format. Use \"-\" for stdout.")
+	window := fs.Duration("window", 2*time.Hour, "Time range to read at once, and to write into each TSDB block.")
+	var selectors stringList
+	fs.Var(&selectors, "match", "Series selector, like `{job=\"node\"}`. Can be repeated (default: all series).")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if *start == "" {
+		fs.Usage()
+		return fmt.Errorf("the start of the time range is required")
+	}
+	if *window < time.Millisecond {
+		return fmt.Errorf("window must be at least 1ms")
+	}
+
+	e := &exporter{window: window.Milliseconds(), end: time.Now().UnixMilli()}
+	var err error
+	if e.start, err = parseTimestamp(*start); err != nil {
+		return err
+	}
+	if *end != "" {
+		if e.end, err = parseTimestamp(*end); err != nil {
+			return err
+		}
+	}
+	matcherSets, err := parseSelectors(selectors)
+	if err != nil {
+		return err
+	}
+	for _, matchers := range matcherSets {
+		e.matcherSets = append(e.matcherSets, toLabelMatchers(matchers))
+	}
+
+	var w exportWriter
+	switch *format {
+	case exportFormatOpenMetrics, exportFormatCSV:
+		out := os.Stdout
+		if *output != "-" {
+			if out, err = os.Create(*output); err != nil {
+				return err
+			}
+			defer out.Close()
+		}
+		if *format == exportFormatCSV {
+			if w, err = newCSVWriter(out); err != nil {
+				return err
+			}
+		} else {
+			spool, err := os.CreateTemp("", "export-*.om")
+			if err != nil {
+				return err
+			}
+			defer os.Remove(spool.Name())
+			defer spool.Close()
+			w = newOpenMetricsWriter(out, spool)
+		}
+	case exportFormatTSDB:
+		if *output == "-" {
+			return fmt.Errorf("the \"tsdb\" format requires an output directory")
+		}
+		if err := os.MkdirAll(*output, 0o755); err != nil {
+			return err
+		}
+		w = &tsdbWriter{dir: *output, window: e.window}
+	default:
+		return fmt.Errorf("unknown export format %q", *format)
+	}
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	endpoints, ep, err := setupEndpoints(conf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, ep := range endpoints {
+			ep.close()
+		}
+	}()
+	e.ep = ep
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	return e.run(ctx, w)
+}
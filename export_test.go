@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"regexp"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/common/promslog"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/tsdb"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/require"
+)
+
+var stmtTimeRange = regexp.MustCompile(`\(timestamp <= (\d+)\) AND \(timestamp >= (\d+)\)`)
+
+// Create an exporter reading the given rows, filtered by the time range of the
+// queries. The statements of all queries are recorded.
+func testExporter(t *testing.T, window time.Duration, rows []*crateRow, selectors ...string) (*exporter, *[]string) {
+	stmts := []string{}
+	matcherSets, err := parseSelectors(selectors)
+	require.NoError(t, err)
+	e := &exporter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			stmt := request.(*crateReadRequest).stmt
+			stmts = append(stmts, stmt)
+			match := stmtTimeRange.FindStringSubmatch(stmt)
+			end, _ := strconv.ParseInt(match[1], 10, 64)
+			start, _ := strconv.ParseInt(match[2], 10, 64)
+			response := &crateReadResponse{}
+			for _, row := range rows {
+				if ts := row.timestamp.UnixMilli(); ts >= start && ts <= end {
+					response.rows = append(response.rows, row)
+				}
+			}
+			return response, nil
+		},
+		start:  0,
+		end:    4*time.Hour.Milliseconds() - 1,
+		window: window.Milliseconds(),
+	}
+	for _, matchers := range matcherSets {
+		e.matcherSets = append(e.matcherSets, toLabelMatchers(matchers))
+	}
+	return e, &stmts
+}
+
+func testRow(metric model.Metric, timestamp time.Duration, value float64) *crateRow {
+	return &crateRow{
+		labels:    metric,
+		timestamp: time.UnixMilli(timestamp.Milliseconds()),
+		value:     value,
+		valueRaw:  int64(math.Float64bits(value)),
+	}
+}
+
+var exportRows = []*crateRow{
+	testRow(model.Metric{"__name__": "up", "job": "node"}, 0, 1),
+	testRow(model.Metric{"__name__": "up", "job": "prometheus"}, 30*time.Minute, 0),
+	testRow(model.Metric{"__name__": "up", "job": "node"}, 3*time.Hour, math.Inf(1)),
+	testRow(model.Metric{"__name__": "info", "path": "C:\\\"tmp\""}, 3*time.Hour+1500*time.Millisecond, 1),
+}
+
+func TestToLabelMatchers(t *testing.T) {
+	matcherSets, err := parseSelectors([]string{`up{job!="a",instance=~"b.*",path!~"c"}`})
+	require.NoError(t, err)
+	require.ElementsMatch(t, []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: "a"},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "b.*"},
+		{Type: prompb.LabelMatcher_NRE, Name: "path", Value: "c"},
+	}, toLabelMatchers(matcherSets[0]))
+}
+
+func TestExportOpenMetrics(t *testing.T) {
+	e, stmts := testExporter(t, 2*time.Hour, exportRows)
+	out := &bytes.Buffer{}
+	spool, err := os.CreateTemp(t.TempDir(), "spool")
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, e.run(context.Background(), newOpenMetricsWriter(out, spool)))
+	// Families are not interleaved across the windows.
+	require.Equal(t, `# TYPE info unknown
+info{path="C:\\\"tmp\""} 1 10801.5
+# TYPE up unknown
+up{job="node"} 1 0
+up{job="prometheus"} 0 1800
+up{job="node"} +Inf 10800
+# EOF
+`, out.String())
+
+	// The time range is read in windows, which do not overlap.
+	require.Len(t, *stmts, 2)
+	require.Contains(t, (*stmts)[0], "(timestamp <= 7199999) AND (timestamp >= 0)")
+	require.Contains(t, (*stmts)[1], "(timestamp <= 14399999) AND (timestamp >= 7200000)")
+}
+
+func TestExportOpenMetricsParse(t *testing.T) {
+	e, _ := testExporter(t, 30*time.Minute, exportRows)
+	out := &bytes.Buffer{}
+	spool, err := os.CreateTemp(t.TempDir(), "spool")
+	require.NoError(t, err)
+	defer spool.Close()
+	require.NoError(t, e.run(context.Background(), newOpenMetricsWriter(out, spool)))
+
+	// Every sample follows the type of its family, which is declared once.
+	p := textparse.NewOpenMetricsParser(out.Bytes(), labels.NewSymbolTable())
+	types := map[string]model.MetricType{}
+	family := ""
+	samples := []string{}
+	for {
+		entry, err := p.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		require.NoError(t, err)
+		switch entry {
+		case textparse.EntryType:
+			name, typ := p.Type()
+			require.NotContains(t, types, string(name))
+			family = string(name)
+			types[family] = typ
+		case textparse.EntrySeries:
+			var lset labels.Labels
+			p.Labels(&lset)
+			require.Equal(t, family, lset.Get(labels.MetricName))
+			_, ts, value := p.Series()
+			require.NotNil(t, ts)
+			samples = append(samples, fmt.Sprintf("%s %g %d", lset, value, *ts))
+		default:
+			t.Fatalf("unexpected entry %v", entry)
+		}
+	}
+	require.Equal(t, map[string]model.MetricType{"info": model.MetricTypeUnknown, "up": model.MetricTypeUnknown}, types)
+	require.Equal(t, []string{
+		`{__name__="info", path="C:\\\"tmp\""} 1 10801500`,
+		`{__name__="up", job="node"} 1 0`,
+		`{__name__="up", job="prometheus"} 0 1800000`,
+		`{__name__="up", job="node"} +Inf 10800000`,
+	}, samples)
+}
+
+func TestExportCSV(t *testing.T) {
+	e, _ := testExporter(t, time.Hour, exportRows, `{job="node"}`, `up`)
+	out := &bytes.Buffer{}
+	w, err := newCSVWriter(out)
+	require.NoError(t, err)
+	require.NoError(t, e.run(context.Background(), w))
+	// The test endpoint ignores the selectors, so all series match both, but
+	// are only exported once.
+	require.Equal(t, `metric,labels,timestamp,value
+up,"{""job"":""node""}",1970-01-01T00:00:00.000Z,1
+up,"{""job"":""prometheus""}",1970-01-01T00:30:00.000Z,0
+info,"{""path"":""C:\\\""tmp\""""}",1970-01-01T03:00:01.500Z,1
+up,"{""job"":""node""}",1970-01-01T03:00:00.000Z,+Inf
+`, out.String())
+}
+
+func TestExportTSDB(t *testing.T) {
+	dir := t.TempDir()
+	e, _ := testExporter(t, 2*time.Hour, exportRows)
+	require.NoError(t, e.run(context.Background(), &tsdbWriter{dir: dir, window: e.window}))
+
+	db, err := tsdb.OpenDBReadOnly(dir, "", promslog.NewNopLogger())
+	require.NoError(t, err)
+	defer db.Close()
+	blocks, err := db.Blocks()
+	require.NoError(t, err)
+	require.Len(t, blocks, 2)
+
+	samples := map[string][]float64{}
+	for _, block := range blocks {
+		querier, err := tsdb.NewBlockQuerier(block, 0, e.end)
+		require.NoError(t, err)
+		set := querier.Select(context.Background(), true, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+		for set.Next() {
+			job := set.At().Labels().Get("job")
+			it := set.At().Iterator(nil)
+			for it.Next() == chunkenc.ValFloat {
+				_, v := it.At()
+				samples[job] = append(samples[job], v)
+			}
+		}
+		require.NoError(t, set.Err())
+		require.NoError(t, querier.Close())
+	}
+	require.Equal(t, map[string][]float64{"node": {1, math.Inf(1)}, "prometheus": {0}}, samples)
+}
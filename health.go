@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// readiness tells load balancers whether the adapter accepts new requests.
+// The adapter is ready when at least one CrateDB endpoint is usable, and it
+// is not shutting down.
+type readiness struct {
+	endpoints    []*crateEndpoint
+	check        func(ctx context.Context, ep *crateEndpoint) error
+	shuttingDown atomic.Bool
+}
+
+type endpointStatus struct {
+	Endpoint string `json:"endpoint"`
+	Ready    bool   `json:"ready"`
+	Error    string `json:"error,omitempty"`
+}
+
+type readinessStatus struct {
+	Status    string           `json:"status"`
+	Endpoints []endpointStatus `json:"endpoints"`
+}
+
+func newReadiness(endpoints []*crateEndpoint) *readiness {
+	return &readiness{
+		endpoints: endpoints,
+		check: func(ctx context.Context, ep *crateEndpoint) error {
+			return ep.checkReady(ctx)
+		},
+	}
+}
+
+// status checks all endpoints concurrently.
+func (r *readiness) status(ctx context.Context) (*readinessStatus, bool) {
+	status := &readinessStatus{Endpoints: make([]endpointStatus, len(r.endpoints))}
+	var wg sync.WaitGroup
+	for i, ep := range r.endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			status.Endpoints[i] = endpointStatus{Endpoint: ep.name, Ready: true}
+			if err := r.check(ctx, ep); err != nil {
+				status.Endpoints[i].Ready = false
+				status.Endpoints[i].Error = err.Error()
+			}
+		}()
+	}
+	wg.Wait()
+
+	ready := false
+	for _, ep := range status.Endpoints {
+		ready = ready || ep.Ready
+	}
+	switch {
+	case r.shuttingDown.Load():
+		ready = false
+		status.Status = "shutting down"
+	case ready:
+		status.Status = "ready"
+	default:
+		status.Status = "not ready"
+	}
+	return status, ready
+}
+
+// handleReady serves the readiness of the adapter and its endpoints as JSON.
+func (r *readiness) handleReady(w http.ResponseWriter, req *http.Request) {
+	status, ready := r.status(req.Context())
+	w.Header().Set("Content-Type", "application/json")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logger.Error("Failed to encode readiness status", "err", err)
+	}
+}
+
+// handleHealthy reports that the process is alive.
+func handleHealthy(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("Healthy\n"))
+}
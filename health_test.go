@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealthyHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handleHealthy(rec, httptest.NewRequest("GET", "/-/healthy", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestReadinessHandler(t *testing.T) {
+	endpoints := []*crateEndpoint{{name: "a"}, {name: "b"}}
+	failing := map[string]bool{"a": true}
+	ready := newReadiness(endpoints)
+	ready.check = func(ctx context.Context, ep *crateEndpoint) error {
+		if failing[ep.name] {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	getStatus := func() (int, *readinessStatus) {
+		rec := httptest.NewRecorder()
+		ready.handleReady(rec, httptest.NewRequest("GET", "/-/ready", nil))
+		status := &readinessStatus{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), status))
+		return rec.Code, status
+	}
+
+	// One usable endpoint is enough.
+	code, status := getStatus()
+	require.Equal(t, http.StatusOK, code)
+	require.Equal(t, "ready", status.Status)
+	require.Equal(t, []endpointStatus{
+		{Endpoint: "a", Ready: false, Error: "connection refused"},
+		{Endpoint: "b", Ready: true},
+	}, status.Endpoints)
+
+	failing["b"] = true
+	code, status = getStatus()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "not ready", status.Status)
+
+	failing = map[string]bool{}
+	ready.shuttingDown.Store(true)
+	code, status = getStatus()
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.Equal(t, "shutting down", status.Status)
+}
+
+func TestCheckReadyUnavailable(t *testing.T) {
+	conf := builtinConfig()
+	conf.Endpoints[0].Port = 1
+	endpoint, err := newCrateEndpoint(&conf.Endpoints[0])
+	require.NoError(t, err)
+	require.ErrorContains(t, endpoint.checkReady(context.Background()), "error acquiring connection")
+}
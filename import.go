@@ -0,0 +1,338 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/textparse"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+const (
+	importFormatAuto        = "auto"
+	importFormatText        = "text"
+	importFormatOpenMetrics = "openmetrics"
+)
+
+// importOptions configures how imported samples are converted.
+type importOptions struct {
+	// Timestamp of samples without an explicit timestamp, in milliseconds.
+	timestamp int64
+	// Labels added to all samples, replacing existing labels of the same name.
+	extraLabels model.LabelSet
+}
+
+// Parse extra labels given as `name=value`.
+func parseExtraLabels(values []string) (model.LabelSet, error) {
+	extraLabels := model.LabelSet{}
+	for _, v := range values {
+		name, value, ok := strings.Cut(v, "=")
+		if !ok || !model.UTF8Validation.IsValidLabelName(name) {
+			return nil, fmt.Errorf("invalid extra label %q, use name=value", v)
+		}
+		extraLabels[model.LabelName(name)] = model.LabelValue(value)
+	}
+	return extraLabels, nil
+}
+
+// Detect the format of an exposition. OpenMetrics expositions end with `# EOF`.
+func detectImportFormat(body []byte) expfmt.Format {
+	if bytes.HasSuffix(bytes.TrimRight(body, "\n"), []byte("# EOF")) {
+		return expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	return expfmt.NewFormat(expfmt.TypeTextPlain)
+}
+
+// importBuilder groups the parsed samples into time series.
+type importBuilder struct {
+	opts *importOptions
+	req  *prompb.WriteRequest
+	// Index of the series in the request, by fingerprint.
+	series map[model.Fingerprint]int
+}
+
+func newImportBuilder(opts *importOptions) *importBuilder {
+	return &importBuilder{opts: opts, req: &prompb.WriteRequest{}, series: map[model.Fingerprint]int{}}
+}
+
+func (b *importBuilder) add(metric model.Metric, timestamp int64, value float64) {
+	for name, value := range b.opts.extraLabels {
+		metric[name] = value
+	}
+	fp := metric.Fingerprint()
+	i, ok := b.series[fp]
+	if !ok {
+		ts := prompb.TimeSeries{}
+		for name, value := range metric {
+			ts.Labels = append(ts.Labels, prompb.Label{Name: string(name), Value: string(value)})
+		}
+		i = len(b.req.Timeseries)
+		b.series[fp] = i
+		b.req.Timeseries = append(b.req.Timeseries, ts)
+	}
+	b.req.Timeseries[i].Samples = append(b.req.Timeseries[i].Samples, prompb.Sample{Timestamp: timestamp, Value: value})
+}
+
+// Parse an exposition in the Prometheus text, Prometheus protobuf, or
+// OpenMetrics text format.
+func parseExposition(body []byte, format expfmt.Format, opts *importOptions) (*prompb.WriteRequest, error) {
+	b := newImportBuilder(opts)
+	if format.FormatType() == expfmt.TypeOpenMetrics {
+		if err := parseOpenMetrics(body, b); err != nil {
+			return nil, err
+		}
+		return b.req, nil
+	}
+
+	decoder := &expfmt.SampleDecoder{
+		Dec:  expfmt.NewDecoder(bytes.NewReader(body), format),
+		Opts: &expfmt.DecodeOptions{Timestamp: model.Time(opts.timestamp)},
+	}
+	for {
+		var samples model.Vector
+		if err := decoder.Decode(&samples); errors.Is(err, io.EOF) {
+			break
+		} else if err != nil {
+			return nil, fmt.Errorf("error parsing exposition: %v", err)
+		}
+		for _, s := range samples {
+			b.add(s.Metric, int64(s.Timestamp), float64(s.Value))
+		}
+	}
+	return b.req, nil
+}
+
+// The `expfmt` package can not decode OpenMetrics, which uses timestamps in
+// seconds and requires `# EOF`, so the parser used by Prometheus for scraping
+// is used instead.
+func parseOpenMetrics(body []byte, b *importBuilder) error {
+	parser := textparse.NewOpenMetricsParser(body, labels.NewSymbolTable())
+	for {
+		entry, err := parser.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error parsing OpenMetrics exposition: %v", err)
+		}
+		if entry != textparse.EntrySeries {
+			continue
+		}
+		_, ts, value := parser.Series()
+		var lset labels.Labels
+		parser.Labels(&lset)
+		metric := model.Metric{}
+		lset.Range(func(l labels.Label) {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		})
+		timestamp := b.opts.timestamp
+		if ts != nil {
+			timestamp = *ts
+		}
+		b.add(metric, timestamp, value)
+	}
+}
+
+// Determine the format of a request body by its content type. Without a known
+// content type, the format is detected from the body.
+func requestImportFormat(h http.Header, body []byte) expfmt.Format {
+	if mediaType, _, err := mime.ParseMediaType(h.Get("Content-Type")); err == nil && mediaType == expfmt.OpenMetricsType {
+		return expfmt.NewFormat(expfmt.TypeOpenMetrics)
+	}
+	if format := expfmt.ResponseFormat(h); format != expfmt.FmtUnknown {
+		return format
+	}
+	return detectImportFormat(body)
+}
+
+// Size limits of the request bodies of the import, push and InfluxDB write
+// endpoints, before and after decompression, so that clients can not exhaust
+// the memory of the adapter. Variables, so that tests can lower them.
+var (
+	maxRequestBodySize      int64 = 32 << 20
+	maxDecompressedBodySize int64 = 256 << 20
+)
+
+// readRequestBody reads the body of a write request, decompressing it when it
+// is gzip encoded. On failure, it also returns the status code to respond with,
+// which is `413 Request Entity Too Large` when exceeding the size limits.
+func readRequestBody(w http.ResponseWriter, r *http.Request) ([]byte, int, error) {
+	var reader io.Reader = http.MaxBytesReader(w, r.Body, maxRequestBodySize)
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			return nil, requestBodyErrorStatus(err), err
+		}
+		defer gz.Close()
+		reader = gz
+	}
+	body, err := io.ReadAll(io.LimitReader(reader, maxDecompressedBodySize+1))
+	if err != nil {
+		return nil, requestBodyErrorStatus(err), err
+	}
+	if int64(len(body)) > maxDecompressedBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("decompressed request body too large, exceeding %d bytes", maxDecompressedBodySize)
+	}
+	return body, http.StatusOK, nil
+}
+
+func requestBodyErrorStatus(err error) int {
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// handleImport writes the samples of a text exposition to CrateDB. The
+// `timestamp` parameter sets the timestamp of samples without one, and
+// `extra_label=name=value` parameters add labels to all samples.
+func (ca *crateDbPrometheusAdapter) handleImport(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	opts := &importOptions{timestamp: time.Now().UnixMilli()}
+	var err error
+	if ts := r.URL.Query().Get("timestamp"); ts != "" {
+		if opts.timestamp, err = parseTimestamp(ts); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if opts.extraLabels, err = parseExtraLabels(r.URL.Query()["extra_label"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, span := startSpan(ctx, "decode request")
+	body, code, err := readRequestBody(w, r)
+	if err != nil {
+		endSpan(span, err)
+		logger.Error("Failed to read body", "err", err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	req, err := parseExposition(body, requestImportFormat(r.Header, body), opts)
+	endSpan(span, err)
+	if err != nil {
+		logger.Error("Failed to parse body", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, span = startSpan(ctx, "convert timeseries")
+	request := writesToCrateRequest(req, ca.writeRelabelConfigs)
+	if ca.cardinality != nil {
+		request = ca.cardinality.filter(request)
+	}
+	endSpan(span, nil)
+
+	ca.writeRows(ctx, w, request)
+}
+
+// Run the `import` subcommand, writing the samples of text exposition files to CrateDB.
+func runImport(args []string) error {
+	fs := flag.NewFlagSet("import", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: cratedb-prometheus-adapter import [flags] <file>...")
+		fs.PrintDefaults()
+	}
+	configFile := fs.String("config.file", "", "Path to the CrateDB endpoints configuration file.")
+	format := fs.String("format", importFormatAuto, "Input format, either \"text\", \"openmetrics\", or \"auto\" to detect it.")
+	timestamp := fs.String("timestamp", "", "Timestamp of samples without one, as RFC 3339 or Unix timestamp (default: now).")
+	batchSize := fs.Int("batch-size", 5000, "Maximum number of samples per write request.")
+	var extraLabels stringList
+	fs.Var(&extraLabels, "label", "Label to add to all samples, like `env=ci`. Can be repeated.")
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return err
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return fmt.Errorf("expected files to import, or \"-\" for stdin")
+	}
+	if *batchSize < 1 {
+		return fmt.Errorf("batch size must be positive")
+	}
+	switch *format {
+	case importFormatAuto, importFormatText, importFormatOpenMetrics:
+	default:
+		return fmt.Errorf("unknown import format %q", *format)
+	}
+
+	opts := &importOptions{timestamp: time.Now().UnixMilli()}
+	var err error
+	if *timestamp != "" {
+		if opts.timestamp, err = parseTimestamp(*timestamp); err != nil {
+			return err
+		}
+	}
+	if opts.extraLabels, err = parseExtraLabels(extraLabels); err != nil {
+		return err
+	}
+
+	conf, err := loadConfig(*configFile)
+	if err != nil {
+		return err
+	}
+	endpoints, ep, err := setupEndpoints(conf)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, ep := range endpoints {
+			ep.close()
+		}
+	}()
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	for _, file := range fs.Args() {
+		var body []byte
+		if file == "-" {
+			body, err = io.ReadAll(os.Stdin)
+		} else {
+			body, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return err
+		}
+		fileFormat := detectImportFormat(body)
+		switch *format {
+		case importFormatText:
+			fileFormat = expfmt.NewFormat(expfmt.TypeTextPlain)
+		case importFormatOpenMetrics:
+			fileFormat = expfmt.NewFormat(expfmt.TypeOpenMetrics)
+		}
+		req, err := parseExposition(body, fileFormat, opts)
+		if err != nil {
+			return fmt.Errorf("%s: %v", file, err)
+		}
+		rows := writesToCrateRequest(req, conf.WriteRelabelConfigs).rows
+		for len(rows) > 0 {
+			n := min(len(rows), *batchSize)
+			if _, err := ep(ctx, &crateWriteRequest{rows: rows[:n]}); err != nil {
+				return fmt.Errorf("%s: %w", file, err)
+			}
+			rows = rows[n:]
+		}
+		logger.Info("Imported file", "file", file, "series", len(req.Timeseries))
+	}
+	return nil
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/common/expfmt"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+// Index the samples of a write request by series.
+func importedSamples(req *prompb.WriteRequest) map[string][]prompb.Sample {
+	samples := map[string][]prompb.Sample{}
+	for _, ts := range req.Timeseries {
+		metric := model.Metric{}
+		for _, l := range ts.Labels {
+			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+		}
+		samples[metric.String()] = append(samples[metric.String()], ts.Samples...)
+	}
+	return samples
+}
+
+// Create an adapter recording the rows written to CrateDB.
+func recordingAdapter() (*crateDbPrometheusAdapter, *[]*crateRow) {
+	rows := []*crateRow{}
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			rows = append(rows, request.(*crateWriteRequest).rows...)
+			return nil, nil
+		},
+	}
+	return ca, &rows
+}
+
+func TestParseExpositionText(t *testing.T) {
+	body := []byte(`# HELP http_requests_total Requests.
+# TYPE http_requests_total counter
+http_requests_total{code="200"} 1027 1700000000000
+http_requests_total{code="500"} 3
+# TYPE rpc_duration_seconds summary
+rpc_duration_seconds{quantile="0.5"} 0.05
+rpc_duration_seconds_sum 17
+rpc_duration_seconds_count 100
+`)
+	req, err := parseExposition(body, detectImportFormat(body), &importOptions{timestamp: 42})
+	require.NoError(t, err)
+	require.Equal(t, map[string][]prompb.Sample{
+		`http_requests_total{code="200"}`:      {{Timestamp: 1700000000000, Value: 1027}},
+		`http_requests_total{code="500"}`:      {{Timestamp: 42, Value: 3}},
+		`rpc_duration_seconds{quantile="0.5"}`: {{Timestamp: 42, Value: 0.05}},
+		`rpc_duration_seconds_sum`:             {{Timestamp: 42, Value: 17}},
+		`rpc_duration_seconds_count`:           {{Timestamp: 42, Value: 100}},
+	}, importedSamples(req))
+
+	_, err = parseExposition([]byte("not a metric\n"), detectImportFormat(nil), &importOptions{})
+	require.Error(t, err)
+}
+
+func TestParseExpositionOpenMetrics(t *testing.T) {
+	body := []byte(`# TYPE up gauge
+up{job="node"} 1 1700000000.5
+up{job="node"} 0 1700000060
+up{job="prometheus"} 1
+# EOF
+`)
+	format := detectImportFormat(body)
+	require.Equal(t, expfmt.TypeOpenMetrics, format.FormatType())
+
+	opts := &importOptions{timestamp: 42, extraLabels: model.LabelSet{"env": "ci", "job": "override"}}
+	req, err := parseExposition(body, format, opts)
+	require.NoError(t, err)
+	// Timestamps are given in seconds, and extra labels replace existing ones.
+	require.Equal(t, map[string][]prompb.Sample{
+		`up{env="ci", job="override"}`: {
+			{Timestamp: 1700000000500, Value: 1},
+			{Timestamp: 1700000060000, Value: 0},
+			{Timestamp: 42, Value: 1},
+		},
+	}, importedSamples(req))
+
+	// OpenMetrics requires `# EOF`.
+	_, err = parseExposition([]byte("up 1\n"), format, opts)
+	require.Error(t, err)
+}
+
+func TestParseExtraLabels(t *testing.T) {
+	extraLabels, err := parseExtraLabels([]string{"env=ci", "empty=", "url=a=b"})
+	require.NoError(t, err)
+	require.Equal(t, model.LabelSet{"env": "ci", "empty": "", "url": "a=b"}, extraLabels)
+
+	for _, v := range []string{"env", "=ci", ""} {
+		_, err := parseExtraLabels([]string{v})
+		require.Error(t, err, v)
+	}
+}
+
+func TestHandleImport(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	ca, rows := recordingAdapter()
+
+	req := httptest.NewRequest("POST", "/api/v1/import/prometheus?timestamp=1700000000&extra_label=env=ci", bytes.NewBufferString("up{job=\"node\"} 1\n"))
+	rec := httptest.NewRecorder()
+	ca.handleImport(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, *rows, 1)
+	require.Equal(t, model.Metric{"__name__": "up", "job": "node", "env": "ci"}, (*rows)[0].labels)
+	require.Equal(t, int64(1700000000000), (*rows)[0].timestamp.UnixMilli())
+
+	// Compressed OpenMetrics, announced by the content type.
+	*rows = (*rows)[:0]
+	body := &bytes.Buffer{}
+	gz := gzip.NewWriter(body)
+	_, err := gz.Write([]byte("up 1 1700000000\nup 0 1700000015\n# EOF\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+	req = httptest.NewRequest("POST", "/api/v1/import/prometheus", body)
+	req.Header.Set("Content-Type", "application/openmetrics-text; version=1.0.0")
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	ca.handleImport(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, *rows, 2)
+	require.Equal(t, int64(1700000015000), (*rows)[1].timestamp.UnixMilli())
+}
+
+func TestReadRequestBody(t *testing.T) {
+	defer func(size, decompressed int64) {
+		maxRequestBodySize, maxDecompressedBodySize = size, decompressed
+	}(maxRequestBodySize, maxDecompressedBodySize)
+	maxRequestBodySize, maxDecompressedBodySize = 100, 1000
+
+	gzipped := func(data []byte) *bytes.Buffer {
+		body := &bytes.Buffer{}
+		gz := gzip.NewWriter(body)
+		_, err := gz.Write(data)
+		require.NoError(t, err)
+		require.NoError(t, gz.Close())
+		return body
+	}
+	for _, tc := range []struct {
+		name string
+		body *bytes.Buffer
+		gzip bool
+		code int
+	}{
+		{"plain", bytes.NewBuffer(make([]byte, 100)), false, http.StatusOK},
+		{"plain too large", bytes.NewBuffer(make([]byte, 101)), false, http.StatusRequestEntityTooLarge},
+		{"gzip", gzipped(make([]byte, 1000)), true, http.StatusOK},
+		// A small compressed body must not decompress to an arbitrary size.
+		{"gzip too large", gzipped(make([]byte, 1001)), true, http.StatusRequestEntityTooLarge},
+		{"gzip invalid", bytes.NewBufferString("up 1\n"), true, http.StatusBadRequest},
+	} {
+		req := httptest.NewRequest("POST", "/api/v1/import/prometheus", tc.body)
+		if tc.gzip {
+			req.Header.Set("Content-Encoding", "gzip")
+		}
+		_, code, err := readRequestBody(httptest.NewRecorder(), req)
+		require.Equal(t, tc.code, code, tc.name)
+		require.Equal(t, tc.code == http.StatusOK, err == nil, tc.name)
+	}
+}
+
+func TestHandleImportInvalid(t *testing.T) {
+	ca, rows := recordingAdapter()
+	for _, target := range []string{
+		"/api/v1/import/prometheus?timestamp=yesterday",
+		"/api/v1/import/prometheus?extra_label=env",
+	} {
+		rec := httptest.NewRecorder()
+		ca.handleImport(rec, httptest.NewRequest("POST", target, bytes.NewBufferString("up 1\n")))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+
+	rec := httptest.NewRecorder()
+	ca.handleImport(rec, httptest.NewRequest("POST", "/api/v1/import/prometheus", bytes.NewBufferString("up{\n")))
+	require.Equal(t, http.StatusBadRequest, rec.Code)
+	require.Empty(t, *rows)
+}
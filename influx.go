@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+// Durations of the timestamp precisions of the InfluxDB v1 and v2 write APIs.
+var influxPrecisions = map[string]int64{
+	"":   int64(time.Nanosecond),
+	"n":  int64(time.Nanosecond),
+	"ns": int64(time.Nanosecond),
+	"u":  int64(time.Microsecond),
+	"us": int64(time.Microsecond),
+	"ms": int64(time.Millisecond),
+	"s":  int64(time.Second),
+	"m":  int64(time.Minute),
+	"h":  int64(time.Hour),
+}
+
+// Split a line protocol element at unescaped separators. With `quotes`, the
+// separators within double quotes are ignored. Double quotes only enclose
+// string field values, and are literal characters of measurements and tags.
+func splitLineProtocol(s string, sep byte, quotes bool) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// Cut a line protocol element at the first unescaped separator.
+func cutLineProtocol(s string, sep byte) (before string, after string, found bool) {
+	parts := splitLineProtocol(s, sep, false)
+	if len(parts) == 1 {
+		return s, "", false
+	}
+	return parts[0], s[len(parts[0])+1:], true
+}
+
+// Escaping of measurements, tag keys, tag values and field keys.
+var lineProtocolUnescaper = strings.NewReplacer(`\,`, ",", `\=`, "=", `\ `, " ")
+
+// Parse a field value into a sample value. Strings can not be stored as
+// samples, which is reported by returning false.
+func parseFieldValue(s string) (float64, bool, error) {
+	switch {
+	case strings.HasPrefix(s, `"`):
+		return 0, false, nil
+	case strings.HasSuffix(s, "i"):
+		v, err := strconv.ParseInt(s[:len(s)-1], 10, 64)
+		return float64(v), true, err
+	case strings.HasSuffix(s, "u"):
+		v, err := strconv.ParseUint(s[:len(s)-1], 10, 64)
+		return float64(v), true, err
+	}
+	switch s {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	return v, true, err
+}
+
+// Parse InfluxDB line protocol. Every field becomes a series named by the
+// measurement and field key, with the tags as labels. Timestamps are given in
+// multiples of `precision` nanoseconds, and default to `now`.
+func parseLineProtocol(body []byte, precision int64, now int64) (*prompb.WriteRequest, int, error) {
+	b := newImportBuilder(&importOptions{timestamp: now})
+	skipped := 0
+	for n, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 || line[0] == '#' {
+			continue
+		}
+		// The series key ends at the first unescaped space, and is followed by
+		// the field set, whose string values may contain quoted spaces.
+		key, rest, _ := cutLineProtocol(string(line), ' ')
+		sections := []string{key}
+		for _, section := range splitLineProtocol(rest, ' ', true) {
+			if section != "" {
+				sections = append(sections, section)
+			}
+		}
+		if len(sections) < 2 || len(sections) > 3 {
+			return nil, 0, fmt.Errorf("line %d: expected measurement, fields and optional timestamp", n+1)
+		}
+
+		timestamp := now
+		if len(sections) == 3 {
+			ts, err := strconv.ParseInt(sections[2], 10, 64)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: invalid timestamp %q", n+1, sections[2])
+			}
+			timestamp = ts * precision / int64(time.Millisecond)
+		}
+
+		series := splitLineProtocol(sections[0], ',', false)
+		measurement := lineProtocolUnescaper.Replace(series[0])
+		if measurement == "" {
+			return nil, 0, fmt.Errorf("line %d: missing measurement", n+1)
+		}
+		tags := model.Metric{}
+		for _, tag := range series[1:] {
+			kv := splitLineProtocol(tag, '=', false)
+			if len(kv) != 2 || kv[0] == "" {
+				return nil, 0, fmt.Errorf("line %d: invalid tag %q", n+1, tag)
+			}
+			name := model.EscapeName(lineProtocolUnescaper.Replace(kv[0]), model.UnderscoreEscaping)
+			tags[model.LabelName(name)] = model.LabelValue(lineProtocolUnescaper.Replace(kv[1]))
+		}
+
+		for _, field := range splitLineProtocol(sections[1], ',', true) {
+			// The field key ends at the first unescaped `=`, while string
+			// values may contain further ones.
+			fieldKey, fieldValue, found := cutLineProtocol(field, '=')
+			if !found || fieldKey == "" || fieldValue == "" {
+				return nil, 0, fmt.Errorf("line %d: invalid field %q", n+1, field)
+			}
+			value, ok, err := parseFieldValue(fieldValue)
+			if err != nil {
+				return nil, 0, fmt.Errorf("line %d: invalid value of field %q", n+1, field)
+			}
+			if !ok {
+				skipped++
+				continue
+			}
+			metric := make(model.Metric, len(tags)+1)
+			for name, value := range tags {
+				metric[name] = value
+			}
+			name := measurement + "_" + lineProtocolUnescaper.Replace(fieldKey)
+			metric[model.MetricNameLabel] = model.LabelValue(model.EscapeName(name, model.UnderscoreEscaping))
+			b.add(metric, timestamp, value)
+		}
+	}
+	return b.req, skipped, nil
+}
+
+// handleInfluxWrite writes InfluxDB line protocol to CrateDB. It serves both
+// the v1 and v2 write APIs, whose `precision` parameters are both accepted.
+// Other parameters, like the database or bucket, are ignored.
+func (ca *crateDbPrometheusAdapter) handleInfluxWrite(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	precision, ok := influxPrecisions[r.URL.Query().Get("precision")]
+	if !ok {
+		http.Error(w, fmt.Sprintf("invalid precision %q", r.URL.Query().Get("precision")), http.StatusBadRequest)
+		return
+	}
+
+	_, span := startSpan(ctx, "decode request")
+	body, code, err := readRequestBody(w, r)
+	if err != nil {
+		endSpan(span, err)
+		logger.Error("Failed to read body", "err", err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	req, skipped, err := parseLineProtocol(body, precision, time.Now().UnixMilli())
+	endSpan(span, err)
+	if err != nil {
+		logger.Error("Failed to parse body", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if skipped > 0 {
+		metrics.dropSamples("unsupported_type", skipped)
+	}
+
+	_, span = startSpan(ctx, "convert timeseries")
+	request := writesToCrateRequest(req, ca.writeRelabelConfigs)
+	if ca.cardinality != nil {
+		request = ca.cardinality.filter(request)
+	}
+	endSpan(span, nil)
+
+	ca.writeRows(ctx, w, request)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseLineProtocol(t *testing.T) {
+	body := []byte(`# comment
+cpu,host=server01,region=us-west usage_idle=92.5,usage_user=3i 1700000000000000000
+cpu,host=server01,region=us-west usage_idle=90 1700000010000000000
+
+mem\ stats,host\=name=a\ b\,c used=1u,ok=true,status="up, \"really\""
+disk.io,dev=sda reads=1e3,error=F
+`)
+	req, skipped, err := parseLineProtocol(body, influxPrecisions["ns"], 42)
+	require.NoError(t, err)
+	// The string field can not be stored.
+	require.Equal(t, 1, skipped)
+	require.Equal(t, map[string][]prompb.Sample{
+		`cpu_usage_idle{host="server01", region="us-west"}`: {
+			{Timestamp: 1700000000000, Value: 92.5},
+			{Timestamp: 1700000010000, Value: 90},
+		},
+		`cpu_usage_user{host="server01", region="us-west"}`: {{Timestamp: 1700000000000, Value: 3}},
+		`mem_stats_used{host_name="a b,c"}`:                 {{Timestamp: 42, Value: 1}},
+		`mem_stats_ok{host_name="a b,c"}`:                   {{Timestamp: 42, Value: 1}},
+		`disk_io_reads{dev="sda"}`:                          {{Timestamp: 42, Value: 1000}},
+		`disk_io_error{dev="sda"}`:                          {{Timestamp: 42, Value: 0}},
+	}, importedSamples(req))
+}
+
+func TestParseLineProtocolQuotes(t *testing.T) {
+	// Double quotes are literal characters of measurements and tags, and only
+	// enclose string field values.
+	body := []byte(`disk"s,path="/var",label=a"b used=1,status="a=b, c",free=2 1700000000000000000`)
+	req, skipped, err := parseLineProtocol(body, influxPrecisions["ns"], 42)
+	require.NoError(t, err)
+	require.Equal(t, 1, skipped)
+	require.Equal(t, map[string][]prompb.Sample{
+		`disk_s_used{label="a\"b", path="\"/var\""}`: {{Timestamp: 1700000000000, Value: 1}},
+		`disk_s_free{label="a\"b", path="\"/var\""}`: {{Timestamp: 1700000000000, Value: 2}},
+	}, importedSamples(req))
+}
+
+func TestParseLineProtocolPrecision(t *testing.T) {
+	for precision, ts := range map[string]string{
+		"ns": "1700000000123000000",
+		"us": "1700000000123000",
+		"ms": "1700000000123",
+		"s":  "1700000000",
+		"m":  "28333333",
+	} {
+		req, _, err := parseLineProtocol([]byte("m v=1 "+ts), influxPrecisions[precision], 0)
+		require.NoError(t, err)
+		expected := int64(1700000000123)
+		switch precision {
+		case "s":
+			expected = 1700000000000
+		case "m":
+			expected = 28333333 * time.Minute.Milliseconds()
+		}
+		require.Equal(t, expected, req.Timeseries[0].Samples[0].Timestamp, precision)
+	}
+}
+
+func TestParseLineProtocolInvalid(t *testing.T) {
+	for _, line := range []string{
+		"cpu",
+		"cpu value=1 1 2",
+		"cpu value=1 yesterday",
+		"cpu,host value=1",
+		"cpu value",
+		"cpu value=",
+		"cpu value=1x",
+		"cpu value=1.5i",
+		",host=a value=1",
+	} {
+		_, _, err := parseLineProtocol([]byte(line), 1, 0)
+		require.Error(t, err, line)
+	}
+}
+
+func TestHandleInfluxWrite(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	ca, rows := recordingAdapter()
+
+	req := httptest.NewRequest("POST", "/api/v2/write?org=o&bucket=b&precision=s", bytes.NewBufferString("cpu,host=a usage=0.5 1700000000\n"))
+	rec := httptest.NewRecorder()
+	ca.handleInfluxWrite(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, *rows, 1)
+	require.Equal(t, model.Metric{"__name__": "cpu_usage", "host": "a"}, (*rows)[0].labels)
+	require.Equal(t, int64(1700000000000), (*rows)[0].timestamp.UnixMilli())
+	require.Equal(t, 0.5, (*rows)[0].value)
+
+	for _, target := range []string{"/influx/write?db=telegraf&precision=d", "/api/v2/write"} {
+		rec = httptest.NewRecorder()
+		ca.handleInfluxWrite(rec, httptest.NewRequest("POST", target, bytes.NewBufferString("cpu usage\n")))
+		require.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+	require.Len(t, *rows, 1)
+
+	defer func(size int64) { maxRequestBodySize = size }(maxRequestBodySize)
+	maxRequestBodySize = 10
+	rec = httptest.NewRecorder()
+	ca.handleInfluxWrite(rec, httptest.NewRequest("POST", "/api/v2/write", bytes.NewBufferString("cpu usage=1\n")))
+	require.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+)
+
+const defaultMetricsPrefix = "cratedb_prometheus_adapter_"
+
+// Module-wide `metrics` variable, initialized by `setupMetrics()`.
+var metrics *adapterMetrics
+
+// adapterMetrics holds the self-metrics of the adapter. Instead of generating
+// distinct metric names per operation, the metrics use labels.
+type adapterMetrics struct {
+	prefix   string
+	registry *prometheus.Registry
+
+	requestDuration *prometheus.HistogramVec
+	requests        *prometheus.CounterVec
+	crateDuration   *prometheus.HistogramVec
+	crateErrors     *prometheus.CounterVec
+	crateRetries    *prometheus.CounterVec
+	retriesAborted  *prometheus.CounterVec
+	samples         *prometheus.SummaryVec
+	samplesDropped  *prometheus.CounterVec
+	alertsSent      *prometheus.CounterVec
+	alertErrors     *prometheus.CounterVec
+	alertsDropped   prometheus.Counter
+	queryCache      *prometheus.CounterVec
+
+	// Tenants used as `tenant` label, as the header is set by clients.
+	tenants map[string]bool
+
+	// Metrics using the legacy names, only populated in compatibility mode.
+	legacy map[string]prometheus.Collector
+}
+
+// Set up a new metrics registry, using the given prefix for all metric names.
+// In compatibility mode, the metrics are also exported using their legacy names.
+func setupMetrics(prefix string, legacy bool) {
+	metrics = newAdapterMetrics(prefix, legacy)
+}
+
+func newAdapterMetrics(prefix string, legacy bool) *adapterMetrics {
+	m := &adapterMetrics{
+		prefix:   prefix,
+		registry: prometheus.NewRegistry(),
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                            prefix + "request_duration_seconds",
+			Help:                            "How long it took to respond to requests.",
+			Buckets:                         prometheus.DefBuckets,
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: time.Hour,
+		}, []string{"handler"}),
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "requests_total",
+			Help: "How many requests were handled, by status code and tenant.",
+		}, []string{"handler", "code", "tenant"}),
+		crateDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:                            prefix + "crate_request_duration_seconds",
+			Help:                            "Latency of requests to CrateDB.",
+			Buckets:                         prometheus.DefBuckets,
+			NativeHistogramBucketFactor:     1.1,
+			NativeHistogramMaxBucketNumber:  100,
+			NativeHistogramMinResetDuration: time.Hour,
+		}, []string{"endpoint", "operation"}),
+		crateErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "crate_request_failures_total",
+			Help: "How many requests to CrateDB failed.",
+		}, []string{"endpoint", "operation"}),
+		crateRetries: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "crate_request_retries_total",
+			Help: "How many requests to CrateDB were retries of failed requests.",
+		}, []string{"endpoint", "operation"}),
+		retriesAborted: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "crate_request_retries_aborted_total",
+			Help: "How many failed requests to CrateDB were not retried anymore, by reason.",
+		}, []string{"operation", "reason"}),
+		samples: prometheus.NewSummaryVec(prometheus.SummaryOpts{
+			Name: prefix + "timeseries_samples",
+			Help: "How many samples each written or returned timeseries has.",
+		}, []string{"operation"}),
+		samplesDropped: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "samples_dropped_total",
+			Help: "How many samples were dropped before writing them to CrateDB.",
+		}, []string{"reason"}),
+		alertsSent: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "alerts_sent_total",
+			Help: "How many alerts were sent to Alertmanagers.",
+		}, []string{"alertmanager"}),
+		alertErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "alert_notifications_failed_total",
+			Help: "How many requests sending alerts to Alertmanagers failed.",
+		}, []string{"alertmanager"}),
+		alertsDropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: prefix + "alerts_dropped_total",
+			Help: "How many alerts were dropped, because the alert queue was full.",
+		}),
+		queryCache: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: prefix + "query_cache_lookups_total",
+			Help: "How many buckets of read queries were looked up in the query cache, by result.",
+		}, []string{"result"}),
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requestDuration,
+		m.requests,
+		m.crateDuration,
+		m.crateErrors,
+		m.crateRetries,
+		m.retriesAborted,
+		m.samples,
+		m.samplesDropped,
+		m.alertsSent,
+		m.alertErrors,
+		m.alertsDropped,
+		m.queryCache,
+	)
+
+	if legacy {
+		m.legacy = map[string]prometheus.Collector{}
+		for _, op := range []string{"write", "read"} {
+			m.legacy[op+"_latency_seconds"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name: prefix + op + "_latency_seconds",
+				Help: "How long it took to respond to " + op + " requests.",
+			})
+			m.legacy[op+"_failed_total"] = prometheus.NewCounter(prometheus.CounterOpts{
+				Name: prefix + op + "_failed_total",
+				Help: "How many " + op + " requests returned errors.",
+			})
+			m.legacy[op+"_timeseries_samples"] = prometheus.NewSummary(prometheus.SummaryOpts{
+				Name: prefix + op + "_timeseries_samples",
+				Help: "How many samples each " + op + " timeseries has.",
+			})
+			m.legacy[op+"_crate_latency_seconds"] = prometheus.NewHistogram(prometheus.HistogramOpts{
+				Name: prefix + op + "_crate_latency_seconds",
+				Help: "Latency for " + op + " requests to CrateDB.",
+			})
+			m.legacy[op+"_crate_failed_total"] = prometheus.NewCounter(prometheus.CounterOpts{
+				Name: prefix + op + "_crate_failed_total",
+				Help: "How many " + op + " requests to CrateDB failed.",
+			})
+		}
+		for _, c := range m.legacy {
+			m.registry.MustRegister(c)
+		}
+	}
+	return m
+}
+
+// Observe a value on a legacy metric, when running in compatibility mode.
+func (m *adapterMetrics) observeLegacy(name string, value float64) {
+	switch c := m.legacy[name].(type) {
+	case prometheus.Counter:
+		c.Add(value)
+	case prometheus.Observer:
+		c.Observe(value)
+	}
+}
+
+func (m *adapterMetrics) observeRequest(handler string, code int, tenant string, duration time.Duration) {
+	m.requestDuration.WithLabelValues(handler).Observe(duration.Seconds())
+	m.requests.WithLabelValues(handler, strconv.Itoa(code), tenant).Inc()
+	m.observeLegacy(handler+"_latency_seconds", duration.Seconds())
+	if code >= 400 {
+		m.observeLegacy(handler+"_failed_total", 1)
+	}
+}
+
+func (m *adapterMetrics) observeCrate(endpoint string, operation string, duration time.Duration, err error) {
+	m.crateDuration.WithLabelValues(endpoint, operation).Observe(duration.Seconds())
+	m.observeLegacy(operation+"_crate_latency_seconds", duration.Seconds())
+	if err != nil {
+		m.crateErrors.WithLabelValues(endpoint, operation).Inc()
+		m.observeLegacy(operation+"_crate_failed_total", 1)
+	}
+}
+
+func (m *adapterMetrics) observeRetry(endpoint string, operation string) {
+	m.crateRetries.WithLabelValues(endpoint, operation).Inc()
+}
+
+func (m *adapterMetrics) abortRetries(operation string, reason string) {
+	m.retriesAborted.WithLabelValues(operation, reason).Inc()
+}
+
+func (m *adapterMetrics) observeSamples(operation string, count int) {
+	m.samples.WithLabelValues(operation).Observe(float64(count))
+	m.observeLegacy(operation+"_timeseries_samples", float64(count))
+}
+
+func (m *adapterMetrics) dropSamples(reason string, count int) {
+	m.samplesDropped.WithLabelValues(reason).Add(float64(count))
+}
+
+func (m *adapterMetrics) observeAlerts(alertmanager string, count int, err error) {
+	if err != nil {
+		m.alertErrors.WithLabelValues(alertmanager).Inc()
+		return
+	}
+	m.alertsSent.WithLabelValues(alertmanager).Add(float64(count))
+}
+
+func (m *adapterMetrics) dropAlerts(count int) {
+	m.alertsDropped.Add(float64(count))
+}
+
+func (m *adapterMetrics) observeQueryCache(result string) {
+	m.queryCache.WithLabelValues(result).Inc()
+}
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	r.code = code
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// Set the tenants which are used as `tenant` label. Other tenants are counted
+// as "other", so that clients can not create arbitrarily many series.
+func (m *adapterMetrics) setTenants(tenants []string) {
+	m.tenants = map[string]bool{}
+	for _, tenant := range tenants {
+		m.tenants[tenant] = true
+	}
+}
+
+func (m *adapterMetrics) tenant(r *http.Request) string {
+	tenant := r.Header.Get("X-Scope-OrgID")
+	if tenant == "" || m.tenants[tenant] {
+		return tenant
+	}
+	return "other"
+}
+
+// Instrument an HTTP handler with request latency and status code metrics.
+// The tenant is taken from the `X-Scope-OrgID` header, as used by Cortex and Mimir.
+func (m *adapterMetrics) instrumentHandler(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r)
+		m.observeRequest(handler, rec.code, m.tenant(r), time.Since(start))
+	}
+}
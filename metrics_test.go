@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+)
+
+func gatheredNames(t *testing.T, m *adapterMetrics) []string {
+	families, err := m.registry.Gather()
+	require.NoError(t, err)
+	names := []string{}
+	for _, family := range families {
+		if !strings.HasPrefix(family.GetName(), "go_") && !strings.HasPrefix(family.GetName(), "process_") {
+			names = append(names, family.GetName())
+		}
+	}
+	return names
+}
+
+func TestAdapterMetricsPrefix(t *testing.T) {
+	m := newAdapterMetrics("foo_", false)
+	m.observeRequest("write", 200, "", time.Second)
+	m.observeCrate("crate@localhost:5432/", "write", time.Second, errors.New("failed"))
+	m.observeSamples("write", 3)
+	m.dropSamples("relabel", 1)
+	m.observeAlerts("http://localhost:9093", 1, nil)
+	m.observeAlerts("http://localhost:9093", 1, errors.New("failed"))
+	require.ElementsMatch(t, []string{
+		"foo_alert_notifications_failed_total",
+		"foo_alerts_dropped_total",
+		"foo_alerts_sent_total",
+		"foo_crate_request_duration_seconds",
+		"foo_crate_request_failures_total",
+		"foo_request_duration_seconds",
+		"foo_requests_total",
+		"foo_samples_dropped_total",
+		"foo_timeseries_samples",
+	}, gatheredNames(t, m))
+}
+
+func TestAdapterMetricsLegacyNames(t *testing.T) {
+	m := newAdapterMetrics(defaultMetricsPrefix, true)
+	m.observeRequest("write", 500, "", time.Second)
+	m.observeCrate("crate@localhost:5432/", "read", time.Second, errors.New("failed"))
+
+	names := gatheredNames(t, m)
+	require.Contains(t, names, "cratedb_prometheus_adapter_write_latency_seconds")
+	require.Contains(t, names, "cratedb_prometheus_adapter_read_crate_latency_seconds")
+	require.Equal(t, float64(1), testutil.ToFloat64(m.legacy["write_failed_total"]))
+	require.Equal(t, float64(0), testutil.ToFloat64(m.legacy["read_failed_total"]))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.legacy["read_crate_failed_total"]))
+}
+
+func TestInstrumentHandler(t *testing.T) {
+	m := newAdapterMetrics(defaultMetricsPrefix, false)
+	m.setTenants([]string{"team-a"})
+	handler := m.instrumentHandler("write", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("fail") != "" {
+			http.Error(w, "failed", http.StatusBadRequest)
+		}
+	})
+
+	req := httptest.NewRequest("POST", "/write", nil)
+	req.Header.Set("X-Scope-OrgID", "team-a")
+	handler(httptest.NewRecorder(), req)
+	handler(httptest.NewRecorder(), httptest.NewRequest("POST", "/write?fail=1", nil))
+	// Unknown tenants are counted as "other".
+	for _, tenant := range []string{"team-b", "team-c"} {
+		req := httptest.NewRequest("POST", "/write", nil)
+		req.Header.Set("X-Scope-OrgID", tenant)
+		handler(httptest.NewRecorder(), req)
+	}
+
+	require.Equal(t, float64(1), testutil.ToFloat64(m.requests.WithLabelValues("write", "200", "team-a")))
+	require.Equal(t, float64(1), testutil.ToFloat64(m.requests.WithLabelValues("write", "400", "")))
+	require.Equal(t, float64(2), testutil.ToFloat64(m.requests.WithLabelValues("write", "200", "other")))
+	require.Equal(t, 3, testutil.CollectAndCount(m.requests))
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+)
+
+const pushPathPrefix = "/metrics/job"
+
+// Parse the grouping labels of a push path, like the Pushgateway does:
+// `/metrics/job/<job>{/<label>/<value>}`. Values containing slashes can be
+// given base64url encoded, by appending `@base64` to the label name.
+func parsePushPath(path string) (model.LabelSet, error) {
+	rest, ok := strings.CutPrefix(path, pushPathPrefix)
+	if !ok {
+		return nil, fmt.Errorf("invalid push path %q", path)
+	}
+	// The name of the first label is `job`, or `job@base64`.
+	segments := strings.Split("job"+strings.TrimSuffix(rest, "/"), "/")
+	if len(segments)%2 != 0 {
+		return nil, fmt.Errorf("invalid push path %q, expected /metrics/job/<job>{/<label>/<value>}", path)
+	}
+	grouping := model.LabelSet{}
+	for i := 0; i < len(segments); i += 2 {
+		name, value := segments[i], segments[i+1]
+		if encoded, ok := strings.CutSuffix(name, "@base64"); ok {
+			name = encoded
+			// Padding is optional, and `=` stands for an empty value.
+			decoded, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(value, "="))
+			if err != nil {
+				return nil, fmt.Errorf("invalid base64 value of label %q: %v", name, err)
+			}
+			value = string(decoded)
+		}
+		if !model.UTF8Validation.IsValidLabelName(name) || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return nil, fmt.Errorf("invalid grouping label name %q", name)
+		}
+		if _, ok := grouping[model.LabelName(name)]; ok {
+			return nil, fmt.Errorf("duplicate grouping label %q", name)
+		}
+		grouping[model.LabelName(name)] = model.LabelValue(value)
+	}
+	if grouping[model.JobLabel] == "" {
+		return nil, fmt.Errorf("the job name must not be empty")
+	}
+	return grouping, nil
+}
+
+// handlePush writes the samples of a text or protobuf exposition to CrateDB,
+// like pushed to a Pushgateway. The grouping labels of the path are added to
+// all samples, and the time of the push is used as their timestamp.
+func (ca *crateDbPrometheusAdapter) handlePush(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	if r.Method != http.MethodPut && r.Method != http.MethodPost {
+		w.Header().Set("Allow", "PUT, POST")
+		http.Error(w, "only PUT and POST are supported", http.StatusMethodNotAllowed)
+		return
+	}
+	grouping, err := parsePushPath(r.URL.Path)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	now := time.Now().UnixMilli()
+	opts := &importOptions{timestamp: now, extraLabels: grouping}
+
+	_, span := startSpan(ctx, "decode request")
+	body, code, err := readRequestBody(w, r)
+	if err != nil {
+		endSpan(span, err)
+		logger.Error("Failed to read body", "err", err)
+		http.Error(w, err.Error(), code)
+		return
+	}
+	req, err := parseExposition(body, requestImportFormat(r.Header, body), opts)
+	endSpan(span, err)
+	if err != nil {
+		logger.Error("Failed to parse body", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// Like the Pushgateway, which exposes pushed samples without timestamps.
+	for i := range req.Timeseries {
+		for j := range req.Timeseries[i].Samples {
+			req.Timeseries[i].Samples[j].Timestamp = now
+		}
+	}
+
+	_, span = startSpan(ctx, "convert timeseries")
+	request := writesToCrateRequest(req, ca.writeRelabelConfigs)
+	if ca.cardinality != nil {
+		request = ca.cardinality.filter(request)
+	}
+	endSpan(span, nil)
+
+	ca.writeRows(ctx, w, request)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParsePushPath(t *testing.T) {
+	for path, expected := range map[string]model.LabelSet{
+		"/metrics/job/backup":                         {"job": "backup"},
+		"/metrics/job/backup/":                        {"job": "backup"},
+		"/metrics/job/backup/instance/db1/env/prod":   {"job": "backup", "instance": "db1", "env": "prod"},
+		"/metrics/job@base64/YmFja3VwL2RhaWx5":        {"job": "backup/daily"},
+		"/metrics/job/backup/path@base64/L3Zhci90bXA": {"job": "backup", "path": "/var/tmp"},
+		"/metrics/job/backup/path@base64/=":           {"job": "backup", "path": ""},
+	} {
+		grouping, err := parsePushPath(path)
+		require.NoError(t, err, path)
+		require.Equal(t, expected, grouping, path)
+	}
+
+	for _, path := range []string{
+		"/metrics/job",
+		"/metrics/job/",
+		"/metrics/jobs/backup",
+		"/metrics/job/backup/instance",
+		"/metrics/job/backup/job/other",
+		"/metrics/job/backup/__name__/up",
+		"/metrics/job/backup/path@base64/!!",
+	} {
+		_, err := parsePushPath(path)
+		require.Error(t, err, path)
+	}
+}
+
+func TestHandlePush(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	ca, rows := recordingAdapter()
+
+	before := time.Now()
+	body := bytes.NewBufferString(`# TYPE backup_last_success_timestamp_seconds gauge
+backup_last_success_timestamp_seconds 1.7e+09
+backup_duration_seconds{job="ignored",step="dump"} 42 1000
+`)
+	rec := httptest.NewRecorder()
+	ca.handlePush(rec, httptest.NewRequest("PUT", "/metrics/job/backup/instance/db1", body))
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, *rows, 2)
+
+	metrics := []model.Metric{}
+	for _, row := range *rows {
+		metrics = append(metrics, row.labels)
+		// The time of the push replaces given timestamps.
+		require.WithinRange(t, row.timestamp, before.Truncate(time.Millisecond), time.Now())
+	}
+	require.ElementsMatch(t, []model.Metric{
+		{"__name__": "backup_last_success_timestamp_seconds", "job": "backup", "instance": "db1"},
+		{"__name__": "backup_duration_seconds", "job": "backup", "instance": "db1", "step": "dump"},
+	}, metrics)
+}
+
+func TestHandlePushInvalid(t *testing.T) {
+	defer func(size int64) { maxRequestBodySize = size }(maxRequestBodySize)
+	maxRequestBodySize = 10
+	ca, rows := recordingAdapter()
+	for _, tc := range []struct {
+		method string
+		path   string
+		body   string
+		code   int
+	}{
+		{"GET", "/metrics/job/backup", "", http.StatusMethodNotAllowed},
+		{"DELETE", "/metrics/job/backup", "", http.StatusMethodNotAllowed},
+		{"POST", "/metrics/job/backup/instance", "up 1\n", http.StatusBadRequest},
+		{"POST", "/metrics/job/backup", "up{\n", http.StatusBadRequest},
+		{"POST", "/metrics/job/backup", "backup_duration_seconds 42\n", http.StatusRequestEntityTooLarge},
+	} {
+		rec := httptest.NewRecorder()
+		ca.handlePush(rec, httptest.NewRequest(tc.method, tc.path, bytes.NewBufferString(tc.body)))
+		require.Equal(t, tc.code, rec.Code, tc)
+	}
+	require.Empty(t, *rows)
+}
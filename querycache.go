@@ -0,0 +1,433 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/snappy"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type queryCacheConfig struct {
+	Enabled         bool           `yaml:"enabled"`
+	MaxSamples      int            `yaml:"max_samples"`
+	ImmutableAfter  model.Duration `yaml:"immutable_after"`
+	Directory       string         `yaml:"directory,omitempty"`
+	DirectoryMaxAge model.Duration `yaml:"directory_max_age"`
+}
+
+func (c *queryCacheConfig) validate() error {
+	if c.MaxSamples <= 0 {
+		return fmt.Errorf("query_cache max_samples must be positive")
+	}
+	if c.ImmutableAfter < 0 {
+		return fmt.Errorf("query_cache immutable_after must not be negative")
+	}
+	if c.DirectoryMaxAge < 0 {
+		return fmt.Errorf("query_cache directory_max_age must not be negative")
+	}
+	if c.Directory != "" && !c.Enabled {
+		return fmt.Errorf("query_cache directory requires enabling the query cache")
+	}
+	return nil
+}
+
+// Queries are split into buckets of UTC days, matching the daily partitions of
+// the metrics table.
+const queryCacheBucket = 24 * time.Hour
+
+// How often cache files which have not been used for `directory_max_age` are
+// removed from the cache directory.
+const queryCacheCleanupInterval = time.Hour
+
+// queryCache caches the results of remote read queries for past days, which
+// do not change anymore. Queries are split into day-aligned buckets, of which
+// the past ones are served from an in-memory LRU cache, or from files in the
+// optional cache directory, and only the recent edge is queried from CrateDB.
+type queryCache struct {
+	mtx             sync.Mutex
+	namespace       string
+	maxSamples      int
+	immutableAfter  time.Duration
+	directory       string
+	directoryMaxAge time.Duration
+	now             func() time.Time
+	samples         int
+	lru             *list.List
+	entries         map[string]*list.Element
+	// Incremented on every invalidation, so that results queried before an
+	// invalidation are not cached afterwards.
+	generation uint64
+	cleaned    time.Time
+}
+
+type queryCacheEntry struct {
+	key        string
+	bucket     int64
+	timeseries []*prompb.TimeSeries
+	samples    int
+}
+
+// Create a query cache for the given CrateDB endpoints, whose settings are
+// part of the cache keys, so that a cache directory is never used for the
+// results of a different cluster or schema.
+func newQueryCache(conf *queryCacheConfig, endpoints []endpointConfig) (*queryCache, error) {
+	c := &queryCache{
+		namespace:       queryCacheNamespace(endpoints),
+		maxSamples:      conf.MaxSamples,
+		immutableAfter:  time.Duration(conf.ImmutableAfter),
+		directory:       conf.Directory,
+		directoryMaxAge: time.Duration(conf.DirectoryMaxAge),
+		now:             time.Now,
+		lru:             list.New(),
+		entries:         map[string]*list.Element{},
+	}
+	if c.directory != "" {
+		if err := os.MkdirAll(c.directory, 0o755); err != nil {
+			return nil, fmt.Errorf("error creating query cache directory: %v", err)
+		}
+		c.cleanup()
+	}
+	return c, nil
+}
+
+func queryCacheNamespace(endpoints []endpointConfig) string {
+	names := make([]string, 0, len(endpoints))
+	for i := range endpoints {
+		names = append(names, endpoints[i].toString()+" schema="+endpoints[i].Schema)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Build the cache key of a bucket from the normalized label matchers, whose
+// order does not change the result.
+func (c *queryCache) key(matchers []*prompb.LabelMatcher, bucketStart int64) string {
+	return c.namespace + " " + queryCacheKey(matchers, bucketStart)
+}
+
+func queryCacheKey(matchers []*prompb.LabelMatcher, bucketStart int64) string {
+	sorted := append([]*prompb.LabelMatcher{}, matchers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Name != sorted[j].Name {
+			return sorted[i].Name < sorted[j].Name
+		}
+		if sorted[i].Type != sorted[j].Type {
+			return sorted[i].Type < sorted[j].Type
+		}
+		return sorted[i].Value < sorted[j].Value
+	})
+	return formatMatchers(sorted) + "@" + strconv.FormatInt(bucketStart, 10)
+}
+
+// query runs a remote read query, using `run` to query CrateDB for the
+// buckets which are not cached, and for the recent edge.
+func (c *queryCache) query(ctx context.Context, q *prompb.Query, run func(context.Context, *prompb.Query) ([]*prompb.TimeSeries, error)) ([]*prompb.TimeSeries, error) {
+	bucket := queryCacheBucket.Milliseconds()
+	immutableBefore := c.now().Add(-c.immutableAfter).UnixMilli()
+	parts := [][]*prompb.TimeSeries{}
+	start := q.StartTimestampMs
+	for bucketStart := start - mod(start, bucket); start <= q.EndTimestampMs; bucketStart += bucket {
+		bucketEnd := bucketStart + bucket - 1
+		if bucketEnd >= immutableBefore {
+			break
+		}
+		key := c.key(q.Matchers, bucketStart)
+		timeseries, ok := c.get(key, bucketStart)
+		if !ok {
+			generation := c.currentGeneration()
+			var err error
+			timeseries, err = run(ctx, &prompb.Query{StartTimestampMs: bucketStart, EndTimestampMs: bucketEnd, Matchers: q.Matchers, Hints: q.Hints})
+			if err != nil {
+				return nil, err
+			}
+			c.put(key, bucketStart, timeseries, generation)
+		}
+		parts = append(parts, trimTimeseries(timeseries, start, min(bucketEnd, q.EndTimestampMs)))
+		start = bucketEnd + 1
+	}
+	if start <= q.EndTimestampMs {
+		timeseries, err := run(ctx, &prompb.Query{StartTimestampMs: start, EndTimestampMs: q.EndTimestampMs, Matchers: q.Matchers, Hints: q.Hints})
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, timeseries)
+	}
+	if len(parts) == 1 {
+		return parts[0], nil
+	}
+	return mergeTimeseries(parts), nil
+}
+
+// Euclidean modulo, so that buckets of negative timestamps are aligned as well.
+func mod(a, b int64) int64 {
+	return ((a % b) + b) % b
+}
+
+// Select the samples within the time range, without modifying the cached series.
+func trimTimeseries(timeseries []*prompb.TimeSeries, start int64, end int64) []*prompb.TimeSeries {
+	result := make([]*prompb.TimeSeries, 0, len(timeseries))
+	for _, ts := range timeseries {
+		samples := []prompb.Sample{}
+		for _, s := range ts.Samples {
+			if s.Timestamp >= start && s.Timestamp <= end {
+				samples = append(samples, s)
+			}
+		}
+		if len(samples) > 0 {
+			result = append(result, &prompb.TimeSeries{Labels: ts.Labels, Samples: samples})
+		}
+	}
+	return result
+}
+
+// Merge the results of consecutive time ranges, sorted like query results.
+func mergeTimeseries(parts [][]*prompb.TimeSeries) []*prompb.TimeSeries {
+	merged := map[string]*prompb.TimeSeries{}
+	for _, timeseries := range parts {
+		for _, ts := range timeseries {
+			metric := model.Metric{}
+			for _, l := range ts.Labels {
+				metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+			}
+			m, ok := merged[metric.String()]
+			if !ok {
+				m = &prompb.TimeSeries{Labels: ts.Labels}
+				merged[metric.String()] = m
+			}
+			m.Samples = append(m.Samples, ts.Samples...)
+		}
+	}
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	result := make([]*prompb.TimeSeries, 0, len(merged))
+	for _, name := range names {
+		result = append(result, merged[name])
+	}
+	return result
+}
+
+// invalidate removes the cached buckets containing any of the written rows, so
+// that samples written for past days are visible to read queries.
+func (c *queryCache) invalidate(rows []*crateRow) {
+	bucket := queryCacheBucket.Milliseconds()
+	immutableBefore := c.now().Add(-c.immutableAfter).UnixMilli()
+	buckets := map[int64]struct{}{}
+	for _, row := range rows {
+		t := row.timestamp.UnixMilli()
+		// Only buckets which ended before `immutable_after` are cached.
+		if bucketStart := t - mod(t, bucket); bucketStart+bucket-1 < immutableBefore {
+			buckets[bucketStart] = struct{}{}
+		}
+	}
+	if len(buckets) == 0 {
+		return
+	}
+
+	c.mtx.Lock()
+	c.generation++
+	for elem := c.lru.Front(); elem != nil; {
+		next := elem.Next()
+		if entry := elem.Value.(*queryCacheEntry); hasKey(buckets, entry.bucket) {
+			c.lru.Remove(elem)
+			delete(c.entries, entry.key)
+			c.samples -= entry.samples
+		}
+		elem = next
+	}
+	c.mtx.Unlock()
+
+	if c.directory != "" {
+		for bucketStart := range buckets {
+			files, err := filepath.Glob(filepath.Join(c.directory, queryCacheFilePrefix(bucketStart)+"*"))
+			if err != nil {
+				continue
+			}
+			for _, file := range files {
+				if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+					logger.Warn("Removing query cache file failed", "err", err)
+				}
+			}
+		}
+	}
+	logger.Debug("Invalidated query cache", "days", len(buckets))
+}
+
+func hasKey(m map[int64]struct{}, key int64) bool {
+	_, ok := m[key]
+	return ok
+}
+
+func (c *queryCache) currentGeneration() uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	return c.generation
+}
+
+// get looks a bucket up in memory, and then in the cache directory.
+func (c *queryCache) get(key string, bucketStart int64) ([]*prompb.TimeSeries, bool) {
+	c.mtx.Lock()
+	if elem, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(elem)
+		c.mtx.Unlock()
+		metrics.observeQueryCache("memory")
+		return elem.Value.(*queryCacheEntry).timeseries, true
+	}
+	c.mtx.Unlock()
+
+	if c.directory != "" {
+		timeseries, err := c.readFile(key, bucketStart)
+		if err == nil {
+			metrics.observeQueryCache("disk")
+			c.add(key, bucketStart, timeseries)
+			return timeseries, true
+		}
+		if !os.IsNotExist(err) {
+			logger.Warn("Reading query cache file failed", "err", err)
+		}
+	}
+	metrics.observeQueryCache("miss")
+	return nil, false
+}
+
+// put caches a bucket queried from CrateDB, unless the cache has been
+// invalidated since starting the query at the given generation.
+func (c *queryCache) put(key string, bucketStart int64, timeseries []*prompb.TimeSeries, generation uint64) {
+	if c.currentGeneration() != generation {
+		return
+	}
+	c.add(key, bucketStart, timeseries)
+	if c.directory != "" {
+		if err := c.writeFile(key, bucketStart, timeseries); err != nil {
+			logger.Warn("Writing query cache file failed", "err", err)
+		}
+		c.mtx.Lock()
+		cleanup := time.Since(c.cleaned) >= queryCacheCleanupInterval
+		c.mtx.Unlock()
+		if cleanup {
+			c.cleanup()
+		}
+	}
+}
+
+// add caches a bucket in memory, evicting the least recently used buckets
+// when exceeding the maximum number of samples.
+func (c *queryCache) add(key string, bucketStart int64, timeseries []*prompb.TimeSeries) {
+	entry := &queryCacheEntry{key: key, bucket: bucketStart, timeseries: timeseries}
+	for _, ts := range timeseries {
+		entry.samples += len(ts.Samples)
+	}
+	if entry.samples > c.maxSamples {
+		return
+	}
+
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		c.samples -= elem.Value.(*queryCacheEntry).samples
+		c.lru.Remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.samples += entry.samples
+	for c.samples > c.maxSamples {
+		oldest := c.lru.Remove(c.lru.Back()).(*queryCacheEntry)
+		delete(c.entries, oldest.key)
+		c.samples -= oldest.samples
+	}
+}
+
+// Cache files are named by their day, so that the files of a day can be
+// removed when invalidating it.
+func queryCacheFilePrefix(bucketStart int64) string {
+	return time.UnixMilli(bucketStart).UTC().Format("2006-01-02") + "-"
+}
+
+func (c *queryCache) filename(key string, bucketStart int64) string {
+	hash := sha256.Sum256([]byte(key))
+	return filepath.Join(c.directory, queryCacheFilePrefix(bucketStart)+hex.EncodeToString(hash[:])+".bin")
+}
+
+// Cache files contain the snappy compressed query result in protobuf format,
+// like remote read responses.
+func (c *queryCache) readFile(key string, bucketStart int64) ([]*prompb.TimeSeries, error) {
+	filename := c.filename(key, bucketStart)
+	compressed, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	// Files are removed once they have not been used for `directory_max_age`.
+	now := time.Now()
+	os.Chtimes(filename, now, now)
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		return nil, err
+	}
+	var result prompb.QueryResult
+	if err := result.Unmarshal(data); err != nil {
+		return nil, err
+	}
+	return result.Timeseries, nil
+}
+
+func (c *queryCache) writeFile(key string, bucketStart int64, timeseries []*prompb.TimeSeries) error {
+	data, err := (&prompb.QueryResult{Timeseries: timeseries}).Marshal()
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that concurrent readers never see
+	// partially written files.
+	f, err := os.CreateTemp(c.directory, ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(snappy.Encode(nil, data)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), c.filename(key, bucketStart))
+}
+
+// cleanup removes the cache files which have not been used for
+// `directory_max_age`.
+func (c *queryCache) cleanup() {
+	now := time.Now()
+	c.mtx.Lock()
+	c.cleaned = now
+	c.mtx.Unlock()
+
+	files, err := os.ReadDir(c.directory)
+	if err != nil {
+		logger.Warn("Reading query cache directory failed", "err", err)
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".bin") {
+			continue
+		}
+		info, err := file.Info()
+		if err != nil || now.Sub(info.ModTime()) < c.directoryMaxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.directory, file.Name())); err != nil && !os.IsNotExist(err) {
+			logger.Warn("Removing query cache file failed", "err", err)
+		}
+	}
+}
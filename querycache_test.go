@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+var cacheTestMatchers = []*prompb.LabelMatcher{
+	{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+	{Type: prompb.LabelMatcher_RE, Name: "job", Value: "a|b"},
+}
+
+// A stand-in for CrateDB, returning hourly samples of two series within the
+// queried time range, and recording the queried time ranges.
+func cacheTestRun(queries *[][2]time.Time) func(context.Context, *prompb.Query) ([]*prompb.TimeSeries, error) {
+	return func(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+		*queries = append(*queries, [2]time.Time{time.UnixMilli(q.StartTimestampMs).UTC(), time.UnixMilli(q.EndTimestampMs).UTC()})
+		timeseries := []*prompb.TimeSeries{}
+		for _, job := range []string{"a", "b"} {
+			ts := &prompb.TimeSeries{Labels: []prompb.Label{{Name: "__name__", Value: "up"}, {Name: "job", Value: job}}}
+			hour := time.Hour.Milliseconds()
+			for t := q.StartTimestampMs + mod(-q.StartTimestampMs, hour); t <= q.EndTimestampMs; t += hour {
+				ts.Samples = append(ts.Samples, prompb.Sample{Timestamp: t, Value: float64(t / hour)})
+			}
+			if len(ts.Samples) > 0 {
+				timeseries = append(timeseries, ts)
+			}
+		}
+		return timeseries, nil
+	}
+}
+
+var cacheTestEndpoints = []endpointConfig{{Host: "localhost", Port: 5432, User: "crate"}}
+
+func newTestQueryCache(t *testing.T, conf queryCacheConfig, now time.Time) *queryCache {
+	c, err := newQueryCache(&conf, cacheTestEndpoints)
+	require.NoError(t, err)
+	c.now = func() time.Time { return now }
+	return c
+}
+
+func TestQueryCacheKey(t *testing.T) {
+	reversed := []*prompb.LabelMatcher{cacheTestMatchers[1], cacheTestMatchers[0]}
+	require.Equal(t, queryCacheKey(cacheTestMatchers, 0), queryCacheKey(reversed, 0))
+	require.Equal(t, `{__name__="up", job=~"a|b"}@86400000`, queryCacheKey(reversed, 86400000))
+	require.NotEqual(t, queryCacheKey(cacheTestMatchers, 0), queryCacheKey(cacheTestMatchers[:1], 0))
+
+	// The endpoints and their schemas are part of the key.
+	c := newTestQueryCache(t, queryCacheConfig{MaxSamples: 1}, time.Now())
+	require.Equal(t, `crate@localhost:5432/ schema= {__name__="up", job=~"a|b"}@0`, c.key(cacheTestMatchers, 0))
+	for _, endpoints := range [][]endpointConfig{
+		{{Host: "localhost", Port: 5432, User: "crate", Schema: "other"}},
+		{{Host: "localhost", Port: 5433, User: "crate"}},
+		{{ConnectionString: "postgres://crate@localhost:5432/?options=-csearch_path%3Dother"}},
+	} {
+		other, err := newQueryCache(&queryCacheConfig{MaxSamples: 1}, endpoints)
+		require.NoError(t, err)
+		require.NotEqual(t, c.key(cacheTestMatchers, 0), other.key(cacheTestMatchers, 0))
+	}
+	reordered, err := newQueryCache(&queryCacheConfig{MaxSamples: 1}, []endpointConfig{{Host: "b"}, {Host: "a"}})
+	require.NoError(t, err)
+	require.Equal(t, queryCacheNamespace([]endpointConfig{{Host: "a"}, {Host: "b"}}), reordered.namespace)
+}
+
+func TestQueryCache(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	day := 24 * time.Hour
+	c := newTestQueryCache(t, queryCacheConfig{Enabled: true, MaxSamples: 1000, ImmutableAfter: model.Duration(time.Hour)}, today.Add(12*time.Hour))
+
+	q := &prompb.Query{
+		StartTimestampMs: today.Add(-2*day + 6*time.Hour).UnixMilli(),
+		EndTimestampMs:   today.Add(11 * time.Hour).UnixMilli(),
+		Matchers:         cacheTestMatchers,
+	}
+	var expectedQueries [][2]time.Time
+	expected, err := cacheTestRun(&expectedQueries)(context.Background(), q)
+	require.NoError(t, err)
+
+	// Past days are queried completely, and the recent edge separately.
+	var queries [][2]time.Time
+	result, err := c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Equal(t, expected, result)
+	require.Equal(t, [][2]time.Time{
+		{today.Add(-2 * day), today.Add(-day - time.Millisecond)},
+		{today.Add(-day), today.Add(-time.Millisecond)},
+		{today, today.Add(11 * time.Hour)},
+	}, queries)
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.queryCache.WithLabelValues("miss")))
+
+	// Afterwards, only the recent edge is queried.
+	queries = nil
+	result, err = c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Equal(t, expected, result)
+	require.Equal(t, [][2]time.Time{{today, today.Add(11 * time.Hour)}}, queries)
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.queryCache.WithLabelValues("memory")))
+
+	// Ranges within a single past day are served from the cache only.
+	queries = nil
+	q = &prompb.Query{
+		StartTimestampMs: today.Add(-day + time.Hour).UnixMilli(),
+		EndTimestampMs:   today.Add(-day + 2*time.Hour).UnixMilli(),
+		Matchers:         cacheTestMatchers,
+	}
+	result, err = c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	require.Len(t, result, 2)
+	require.Len(t, result[0].Samples, 2)
+
+	// Days are only cached once they are older than `immutable_after`.
+	c.now = func() time.Time { return today.Add(30 * time.Minute) }
+	queries = nil
+	q.StartTimestampMs = today.Add(-time.Hour).UnixMilli()
+	q.EndTimestampMs = today.Add(30 * time.Minute).UnixMilli()
+	_, err = c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Equal(t, [][2]time.Time{{today.Add(-time.Hour), today.Add(30 * time.Minute)}}, queries)
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	// Each day has 48 samples, so that only two days fit into the cache.
+	c := newTestQueryCache(t, queryCacheConfig{Enabled: true, MaxSamples: 100, ImmutableAfter: model.Duration(time.Hour)}, today.Add(2*time.Hour))
+	var queries [][2]time.Time
+	for _, days := range []int{3, 2, 3, 1, 2} {
+		start := today.Add(-time.Duration(days) * 24 * time.Hour)
+		_, err := c.query(context.Background(), &prompb.Query{StartTimestampMs: start.UnixMilli(), EndTimestampMs: start.Add(time.Hour).UnixMilli(), Matchers: cacheTestMatchers}, cacheTestRun(&queries))
+		require.NoError(t, err)
+	}
+	// The day before yesterday was evicted, as it was used least recently.
+	require.Len(t, queries, 4)
+	require.Equal(t, today.Add(-48*time.Hour), queries[3][0])
+	require.Equal(t, 96, c.samples)
+	require.Equal(t, 2, c.lru.Len())
+
+	// Buckets exceeding the cache size are not cached.
+	c.maxSamples = 10
+	c.add("large", 0, []*prompb.TimeSeries{{Samples: make([]prompb.Sample, 11)}})
+	require.NotContains(t, c.entries, "large")
+}
+
+func TestQueryCacheDirectory(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	conf := queryCacheConfig{Enabled: true, MaxSamples: 1000, ImmutableAfter: model.Duration(time.Hour), Directory: t.TempDir(), DirectoryMaxAge: model.Duration(24 * time.Hour)}
+	q := &prompb.Query{
+		StartTimestampMs: today.Add(-36 * time.Hour).UnixMilli(),
+		EndTimestampMs:   today.Add(-12 * time.Hour).UnixMilli(),
+		Matchers:         cacheTestMatchers,
+	}
+	var queries [][2]time.Time
+	expected, err := newTestQueryCache(t, conf, today.Add(2*time.Hour)).query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+
+	// After a restart, the past days are read from the cache directory.
+	queries = nil
+	result, err := newTestQueryCache(t, conf, today.Add(2*time.Hour)).query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Empty(t, queries)
+	require.Equal(t, expected, result)
+	require.Equal(t, 2.0, testutil.ToFloat64(metrics.queryCache.WithLabelValues("disk")))
+
+	// Files which have not been used for `directory_max_age` are removed.
+	files, err := os.ReadDir(conf.Directory)
+	require.NoError(t, err)
+	require.Len(t, files, 2)
+	require.True(t, strings.HasPrefix(files[0].Name(), "2026-03-08-"))
+	unused := time.Now().Add(-25 * time.Hour)
+	require.NoError(t, os.Chtimes(filepath.Join(conf.Directory, files[0].Name()), unused, unused))
+	newTestQueryCache(t, conf, today.Add(2*time.Hour))
+	files, err = os.ReadDir(conf.Directory)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	require.True(t, strings.HasPrefix(files[0].Name(), "2026-03-09-"))
+
+	// Files are touched when reading them, so that used files are retained.
+	c := newTestQueryCache(t, conf, today.Add(2*time.Hour))
+	name := filepath.Join(conf.Directory, files[0].Name())
+	require.NoError(t, os.Chtimes(name, unused, unused))
+	bucketStart := today.Add(-24 * time.Hour).UnixMilli()
+	_, err = c.readFile(c.key(cacheTestMatchers, bucketStart), bucketStart)
+	require.NoError(t, err)
+	c.cleanup()
+	require.FileExists(t, name)
+
+	require.NoError(t, os.Chtimes(name, unused, unused))
+	c.cleanup()
+	require.NoFileExists(t, name)
+}
+
+func TestQueryCacheInvalidate(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	conf := queryCacheConfig{Enabled: true, MaxSamples: 1000, ImmutableAfter: model.Duration(time.Hour), Directory: t.TempDir(), DirectoryMaxAge: model.Duration(24 * time.Hour)}
+	c := newTestQueryCache(t, conf, today.Add(2*time.Hour))
+	q := &prompb.Query{
+		StartTimestampMs: today.Add(-36 * time.Hour).UnixMilli(),
+		EndTimestampMs:   today.Add(-12 * time.Hour).UnixMilli(),
+		Matchers:         cacheTestMatchers,
+	}
+	var queries [][2]time.Time
+	_, err := c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Len(t, queries, 2)
+
+	// Writing recent samples does not invalidate any cached days.
+	c.invalidate([]*crateRow{{timestamp: today.Add(time.Hour)}})
+	require.Equal(t, 2, c.lru.Len())
+
+	// Writing samples for a cached day invalidates only that day, also on disk.
+	c.invalidate([]*crateRow{{timestamp: today.Add(-2 * time.Hour)}, {timestamp: today.Add(-3 * time.Hour)}})
+	require.Equal(t, 1, c.lru.Len())
+	require.Equal(t, 48, c.samples)
+	files, err := filepath.Glob(filepath.Join(conf.Directory, "2026-03-09-*"))
+	require.NoError(t, err)
+	require.Empty(t, files)
+
+	queries = nil
+	_, err = c.query(context.Background(), q, cacheTestRun(&queries))
+	require.NoError(t, err)
+	require.Equal(t, [][2]time.Time{{today.Add(-24 * time.Hour), today.Add(-time.Millisecond)}}, queries)
+
+	// Results of queries running while invalidating are not cached.
+	c.invalidate([]*crateRow{{timestamp: today.Add(-2 * time.Hour)}})
+	_, err = c.query(context.Background(), q, func(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+		c.invalidate([]*crateRow{{timestamp: today.Add(-2 * time.Hour)}})
+		return nil, nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, 1, c.lru.Len())
+}
+
+func TestQueryCacheError(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	c := newTestQueryCache(t, queryCacheConfig{Enabled: true, MaxSamples: 1000, ImmutableAfter: model.Duration(time.Hour)}, today)
+	q := &prompb.Query{StartTimestampMs: today.Add(-time.Hour).UnixMilli(), EndTimestampMs: today.UnixMilli(), Matchers: cacheTestMatchers}
+	_, err := c.query(context.Background(), q, func(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+		return nil, errors.New("failed")
+	})
+	require.EqualError(t, err, "failed")
+	require.Empty(t, c.entries)
+}
+
+func TestQueryCacheConfigValidate(t *testing.T) {
+	for _, conf := range []queryCacheConfig{
+		{MaxSamples: 0},
+		{MaxSamples: 1, ImmutableAfter: model.Duration(-time.Hour)},
+		{MaxSamples: 1, Directory: "cache"},
+	} {
+		require.Error(t, conf.validate(), conf)
+	}
+}
+
+func TestQueryCacheInvalidateOnWrite(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	today := time.Date(2026, 3, 10, 0, 0, 0, 0, time.UTC)
+	c := newTestQueryCache(t, queryCacheConfig{Enabled: true, MaxSamples: 1000, ImmutableAfter: model.Duration(time.Hour)}, today.Add(2*time.Hour))
+	c.add(c.key(cacheTestMatchers, today.Add(-24*time.Hour).UnixMilli()), today.Add(-24*time.Hour).UnixMilli(), nil)
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, errors.New("failed")
+		},
+		queryCache: c,
+	}
+	// Also failed writes invalidate the cache, as some rows may have been written.
+	require.Error(t, ca.write(context.Background(), &crateWriteRequest{rows: []*crateRow{{timestamp: today.Add(-time.Hour)}}}))
+	require.Empty(t, c.entries)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+)
+
+type queryStatsConfig struct {
+	SlowQueryThreshold model.Duration `yaml:"slow_query_threshold"`
+	MaxQueries         int            `yaml:"max_queries"`
+}
+
+func (c *queryStatsConfig) validate() error {
+	if c.SlowQueryThreshold < 0 {
+		return fmt.Errorf("query_stats slow_query_threshold must not be negative")
+	}
+	if c.MaxQueries <= 0 {
+		return fmt.Errorf("query_stats max_queries must be positive")
+	}
+	return nil
+}
+
+// queryStats aggregates statistics about remote read queries by their label
+// matchers, so that the dashboards causing most load on CrateDB can be found.
+type queryStats struct {
+	mtx        sync.Mutex
+	threshold  time.Duration
+	maxQueries int
+	now        func() time.Time
+	entries    map[string]*queryStatsEntry
+}
+
+type queryStatsEntry struct {
+	Matchers     string    `json:"matchers"`
+	SQL          string    `json:"sql"`
+	Count        int       `json:"count"`
+	Errors       int       `json:"errors"`
+	TotalSeconds float64   `json:"total_seconds"`
+	MaxSeconds   float64   `json:"max_seconds"`
+	Rows         int       `json:"rows"`
+	Series       int       `json:"series"`
+	LastSeen     time.Time `json:"last_seen"`
+}
+
+type queryStatsStatus struct {
+	Queries int               `json:"queries"`
+	Top     []queryStatsEntry `json:"top"`
+}
+
+func newQueryStats(conf *queryStatsConfig) *queryStats {
+	return &queryStats{
+		threshold:  time.Duration(conf.SlowQueryThreshold),
+		maxQueries: conf.MaxQueries,
+		now:        time.Now,
+		entries:    map[string]*queryStatsEntry{},
+	}
+}
+
+// Format label matchers like a PromQL series selector.
+func formatMatchers(matchers []*prompb.LabelMatcher) string {
+	ops := map[prompb.LabelMatcher_Type]string{
+		prompb.LabelMatcher_EQ:  "=",
+		prompb.LabelMatcher_NEQ: "!=",
+		prompb.LabelMatcher_RE:  "=~",
+		prompb.LabelMatcher_NRE: "!~",
+	}
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		parts = append(parts, m.Name+ops[m.Type]+strconv.Quote(m.Value))
+	}
+	return "{" + strings.Join(parts, ", ") + "}"
+}
+
+// record adds a read query to the statistics, and logs it when it was slow.
+func (s *queryStats) record(q *prompb.Query, stmt string, rows int, series int, duration time.Duration, err error) {
+	matchers := formatMatchers(q.Matchers)
+	if s.threshold > 0 && duration >= s.threshold {
+		logger.Warn("Slow query",
+			"matchers", matchers,
+			"start", time.UnixMilli(q.StartTimestampMs).UTC(),
+			"end", time.UnixMilli(q.EndTimestampMs).UTC(),
+			"sql", stmt,
+			"rows", rows,
+			"series", series,
+			"duration", duration,
+			"err", err,
+		)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	entry, ok := s.entries[matchers]
+	if !ok {
+		if len(s.entries) >= s.maxQueries {
+			s.evict()
+		}
+		entry = &queryStatsEntry{Matchers: matchers}
+		s.entries[matchers] = entry
+	}
+	entry.SQL = stmt
+	entry.Count++
+	if err != nil {
+		entry.Errors++
+	}
+	entry.TotalSeconds += duration.Seconds()
+	if duration.Seconds() > entry.MaxSeconds {
+		entry.MaxSeconds = duration.Seconds()
+	}
+	entry.Rows += rows
+	entry.Series += series
+	entry.LastSeen = s.now()
+}
+
+// evict forgets about the query which has not been run for the longest time.
+func (s *queryStats) evict() {
+	var oldest *queryStatsEntry
+	for _, entry := range s.entries {
+		if oldest == nil || entry.LastSeen.Before(oldest.LastSeen) {
+			oldest = entry
+		}
+	}
+	if oldest != nil {
+		delete(s.entries, oldest.Matchers)
+	}
+}
+
+// status returns the top-n queries by total time spent.
+func (s *queryStats) status(n int) *queryStatsStatus {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	status := &queryStatsStatus{
+		Queries: len(s.entries),
+		Top:     make([]queryStatsEntry, 0, len(s.entries)),
+	}
+	for _, entry := range s.entries {
+		status.Top = append(status.Top, *entry)
+	}
+	sort.Slice(status.Top, func(i, j int) bool {
+		if status.Top[i].TotalSeconds != status.Top[j].TotalSeconds {
+			return status.Top[i].TotalSeconds > status.Top[j].TotalSeconds
+		}
+		return status.Top[i].Matchers < status.Top[j].Matchers
+	})
+	if n > 0 && len(status.Top) > n {
+		status.Top = status.Top[:n]
+	}
+	return status
+}
+
+// handleStatus serves the top-N queries by total time as JSON.
+func (s *queryStats) handleStatus(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			http.Error(w, fmt.Sprintf("invalid limit %q", v), http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(s.status(limit)); err != nil {
+		logger.Error("Failed to encode query statistics", "err", err)
+	}
+}
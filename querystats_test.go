@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormatMatchers(t *testing.T) {
+	matchers := []*prompb.LabelMatcher{
+		{Type: prompb.LabelMatcher_EQ, Name: "__name__", Value: "up"},
+		{Type: prompb.LabelMatcher_NEQ, Name: "job", Value: ""},
+		{Type: prompb.LabelMatcher_RE, Name: "instance", Value: "host.*"},
+		{Type: prompb.LabelMatcher_NRE, Name: "env", Value: `"dev"`},
+	}
+	require.Equal(t, `{__name__="up", job!="", instance=~"host.*", env!~"\"dev\""}`, formatMatchers(matchers))
+}
+
+func TestQueryStatsRecord(t *testing.T) {
+	stats := newQueryStats(&queryStatsConfig{MaxQueries: 2})
+	now := time.Unix(0, 0)
+	stats.now = func() time.Time { return now }
+
+	a := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Name: "__name__", Value: "a"}}}
+	b := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Name: "__name__", Value: "b"}}}
+	c := &prompb.Query{Matchers: []*prompb.LabelMatcher{{Name: "__name__", Value: "c"}}}
+
+	stats.record(a, "SELECT a", 10, 2, time.Second, nil)
+	now = now.Add(time.Minute)
+	stats.record(b, "SELECT b", 5, 1, 3*time.Second, nil)
+	now = now.Add(time.Minute)
+	stats.record(a, "SELECT a", 20, 2, 4*time.Second, errors.New("failed"))
+
+	status := stats.status(0)
+	require.Equal(t, 2, status.Queries)
+	require.Equal(t, `{__name__="a"}`, status.Top[0].Matchers)
+	require.Equal(t, 2, status.Top[0].Count)
+	require.Equal(t, 1, status.Top[0].Errors)
+	require.Equal(t, 5.0, status.Top[0].TotalSeconds)
+	require.Equal(t, 4.0, status.Top[0].MaxSeconds)
+	require.Equal(t, 30, status.Top[0].Rows)
+	require.Equal(t, 4, status.Top[0].Series)
+
+	// The least recently run query is evicted when the limit is reached.
+	now = now.Add(time.Minute)
+	stats.record(c, "SELECT c", 1, 1, time.Second, nil)
+	status = stats.status(0)
+	require.Equal(t, 2, status.Queries)
+	require.Equal(t, `{__name__="a"}`, status.Top[0].Matchers)
+	require.Equal(t, `{__name__="c"}`, status.Top[1].Matchers)
+}
+
+func TestRunQueryRecordsStats(t *testing.T) {
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return &crateReadResponse{rows: []*crateRow{
+				{labels: model.Metric{"__name__": "up", "job": "a"}},
+				{labels: model.Metric{"__name__": "up", "job": "a"}},
+				{labels: model.Metric{"__name__": "up", "job": "b"}},
+			}}, nil
+		},
+		queryStats: newQueryStats(&queryStatsConfig{MaxQueries: 10}),
+	}
+	query := &prompb.Query{
+		StartTimestampMs: 1000,
+		EndTimestampMs:   2000,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}
+	_, err := ca.runQuery(context.Background(), query)
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	ca.queryStats.handleStatus(rec, httptest.NewRequest("GET", "/api/v1/status/queries?limit=1", nil))
+	require.Equal(t, 200, rec.Code)
+
+	status := &queryStatsStatus{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), status))
+	require.Len(t, status.Top, 1)
+	require.Equal(t, `{__name__="up"}`, status.Top[0].Matchers)
+	require.Contains(t, status.Top[0].SQL, "(labels['__name__'] = 'up')")
+	require.Equal(t, 3, status.Top[0].Rows)
+	require.Equal(t, 2, status.Top[0].Series)
+
+	rec = httptest.NewRecorder()
+	ca.queryStats.handleStatus(rec, httptest.NewRequest("GET", "/api/v1/status/queries?limit=-1", nil))
+	require.Equal(t, 400, rec.Code)
+}
+
+func TestRunQueryRecordsStatsOnceWithCache(t *testing.T) {
+	day := queryCacheBucket.Milliseconds()
+	queries := 0
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			queries++
+			return &crateReadResponse{rows: []*crateRow{
+				{labels: model.Metric{"__name__": "up", "job": "a"}, timestamp: time.UnixMilli(day * int64(queries))},
+			}}, nil
+		},
+		queryStats: newQueryStats(&queryStatsConfig{MaxQueries: 10}),
+		queryCache: newTestQueryCache(t, queryCacheConfig{MaxSamples: 100}, time.UnixMilli(10*day)),
+	}
+	query := &prompb.Query{
+		StartTimestampMs: day,
+		EndTimestampMs:   4*day - 1,
+		Matchers:         []*prompb.LabelMatcher{{Name: "__name__", Value: "up"}},
+	}
+	_, err := ca.runQuery(context.Background(), query)
+	require.NoError(t, err)
+	// The query is split into one query per day, but recorded only once.
+	require.Equal(t, 3, queries)
+	status := ca.queryStats.status(10)
+	require.Equal(t, 1, status.Queries)
+	require.Equal(t, 1, status.Top[0].Count)
+	require.Equal(t, 3, status.Top[0].Rows)
+	require.Equal(t, 1, status.Top[0].Series)
+	require.Contains(t, status.Top[0].SQL, "(labels['__name__'] = 'up')")
+
+	// Queries answered from the cache are recorded without reading rows.
+	_, err = ca.runQuery(context.Background(), query)
+	require.NoError(t, err)
+	require.Equal(t, 3, queries)
+	status = ca.queryStats.status(10)
+	require.Equal(t, 2, status.Top[0].Count)
+	require.Equal(t, 3, status.Top[0].Rows)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/prometheus/common/model"
+)
+
+// Reasons for not retrying a failed request, used as `reason` label of the
+// aborted retries metric.
+const (
+	retryAbortPermanent   = "permanent"
+	retryAbortMaxAttempts = "max_attempts"
+	retryAbortBudget      = "budget"
+)
+
+// retryPolicyConfig configures how failed requests are retried on the next
+// endpoint chosen by the load balancer.
+type retryPolicyConfig struct {
+	MaxAttempts    int            `yaml:"max_attempts"`
+	InitialBackoff model.Duration `yaml:"initial_backoff"`
+	MaxBackoff     model.Duration `yaml:"max_backoff"`
+	Jitter         float64        `yaml:"jitter"`
+	Budget         model.Duration `yaml:"budget"`
+}
+
+type retryConfig struct {
+	Read  retryPolicyConfig `yaml:"read"`
+	Write retryPolicyConfig `yaml:"write"`
+}
+
+func (c *retryPolicyConfig) setDefaults() {
+	if c.InitialBackoff == 0 {
+		c.InitialBackoff = model.Duration(100 * time.Millisecond)
+	}
+	if c.MaxBackoff == 0 {
+		c.MaxBackoff = model.Duration(5 * time.Second)
+	}
+	if c.Budget == 0 {
+		c.Budget = model.Duration(time.Minute)
+	}
+}
+
+func (c *retryPolicyConfig) validate(name string) error {
+	if c.MaxAttempts < 0 {
+		return fmt.Errorf("retry %s max_attempts must not be negative", name)
+	}
+	if c.InitialBackoff < 0 || c.MaxBackoff < c.InitialBackoff {
+		return fmt.Errorf("retry %s max_backoff must not be smaller than initial_backoff", name)
+	}
+	if c.Jitter < 0 || c.Jitter > 1 {
+		return fmt.Errorf("retry %s jitter must be between 0 and 1", name)
+	}
+	if c.Budget <= 0 {
+		return fmt.Errorf("retry %s budget must be positive", name)
+	}
+	return nil
+}
+
+func (c *retryConfig) validate() error {
+	if err := c.Read.validate("read"); err != nil {
+		return err
+	}
+	return c.Write.validate("write")
+}
+
+// retryPolicy retries failed requests with exponential backoff, until the
+// maximum number of attempts or the time budget is exhausted. Permanent errors,
+// which would fail again, are not retried.
+type retryPolicy struct {
+	operation      string
+	maxAttempts    int
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	jitter         float64
+	budget         time.Duration
+}
+
+// Create a retry policy. Without a configured maximum, each endpoint is tried once.
+func newRetryPolicy(conf *retryPolicyConfig, operation string, endpoints int) *retryPolicy {
+	maxAttempts := conf.MaxAttempts
+	if maxAttempts == 0 {
+		maxAttempts = endpoints
+	}
+	return &retryPolicy{
+		operation:      operation,
+		maxAttempts:    maxAttempts,
+		initialBackoff: time.Duration(conf.InitialBackoff),
+		maxBackoff:     time.Duration(conf.MaxBackoff),
+		jitter:         conf.Jitter,
+		budget:         time.Duration(conf.Budget),
+	}
+}
+
+// Delay after the given number of failed attempts. The delay doubles with each
+// attempt, and is varied by up to the jitter fraction in both directions, using
+// a random number within [0, 1).
+func (p *retryPolicy) backoff(attempt int, random float64) time.Duration {
+	delay := p.initialBackoff
+	for i := 1; i < attempt && delay < p.maxBackoff; i++ {
+		delay *= 2
+	}
+	delay = min(delay, p.maxBackoff)
+	return time.Duration(float64(delay) * (1 + p.jitter*(2*random-1)))
+}
+
+// Check whether a request is worth retrying after the given error.
+func isRetriable(err error) bool {
+	if writeErr, ok := asWriteError(err); ok {
+		return !writeErr.permanent
+	}
+	permanent, _ := classifyError(err)
+	return !permanent
+}
+
+// Wrap a load balancer into an endpoint, retrying failed requests according
+// to the policy. Like with `lb.Retry`, errors are returned as `lb.RetryError`.
+func (p *retryPolicy) endpoint(balancer lb.Balancer) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		ctx, cancel := context.WithTimeout(ctx, p.budget)
+		defer cancel()
+
+		final := lb.RetryError{}
+		for attempt := 1; ; attempt++ {
+			ep, err := balancer.Endpoint()
+			if err != nil {
+				return nil, err
+			}
+			response, err := ep(withRetryAttempt(ctx, attempt), request)
+			if err == nil {
+				return response, nil
+			}
+			final.RawErrors = append(final.RawErrors, err)
+			final.Final = err
+
+			if ctx.Err() == context.Canceled {
+				return nil, final
+			}
+			if !isRetriable(err) {
+				metrics.abortRetries(p.operation, retryAbortPermanent)
+				return nil, final
+			}
+			if attempt >= p.maxAttempts {
+				metrics.abortRetries(p.operation, retryAbortMaxAttempts)
+				return nil, final
+			}
+			delay := p.backoff(attempt, rand.Float64())
+			if deadline, _ := ctx.Deadline(); ctx.Err() != nil || time.Now().Add(delay).After(deadline) {
+				metrics.abortRetries(p.operation, retryAbortBudget)
+				return nil, final
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				metrics.abortRetries(p.operation, retryAbortBudget)
+				return nil, final
+			case <-timer.C:
+			}
+		}
+	}
+}
+
+type retryAttemptKey struct{}
+
+func withRetryAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, retryAttemptKey{}, attempt)
+}
+
+// Number of the current attempt of a request, starting at 1.
+func retryAttempt(ctx context.Context) int {
+	if attempt, ok := ctx.Value(retryAttemptKey{}).(int); ok {
+		return attempt
+	}
+	return 1
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/kit/endpoint"
+	"github.com/go-kit/kit/sd"
+	"github.com/go-kit/kit/sd/lb"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRetryPolicyConfig(t *testing.T) {
+	conf := retryPolicyConfig{}
+	conf.setDefaults()
+	require.NoError(t, conf.validate("read"))
+
+	for _, tc := range []struct {
+		conf retryPolicyConfig
+		err  string
+	}{
+		{retryPolicyConfig{MaxAttempts: -1}, "retry read max_attempts must not be negative"},
+		{retryPolicyConfig{InitialBackoff: model.Duration(time.Second), MaxBackoff: model.Duration(time.Millisecond)}, "retry read max_backoff must not be smaller than initial_backoff"},
+		{retryPolicyConfig{Jitter: 1.5}, "retry read jitter must be between 0 and 1"},
+	} {
+		tc.conf.setDefaults()
+		require.EqualError(t, tc.conf.validate("read"), tc.err)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	policy := newRetryPolicy(&retryPolicyConfig{
+		InitialBackoff: model.Duration(100 * time.Millisecond),
+		MaxBackoff:     model.Duration(time.Second),
+		Jitter:         0.2,
+	}, "read", 3)
+	require.Equal(t, 3, policy.maxAttempts)
+
+	require.Equal(t, 100*time.Millisecond, policy.backoff(1, 0.5))
+	require.Equal(t, 200*time.Millisecond, policy.backoff(2, 0.5))
+	require.Equal(t, 400*time.Millisecond, policy.backoff(3, 0.5))
+	require.Equal(t, time.Second, policy.backoff(10, 0.5))
+	require.Equal(t, time.Second, policy.backoff(100, 0.5))
+
+	// Jitter varies the delay in both directions.
+	require.Equal(t, 80*time.Millisecond, policy.backoff(1, 0))
+	require.Equal(t, 120*time.Millisecond, policy.backoff(1, 1))
+}
+
+func TestIsRetriable(t *testing.T) {
+	require.True(t, isRetriable(errors.New("error opening connection")))
+	require.True(t, isRetriable(&pgconn.PgError{Code: "08006"}))
+	require.False(t, isRetriable(&pgconn.PgError{Code: "42P01"}))
+	require.False(t, isRetriable(&crateWriteError{rows: 1, failed: 1, permanent: true}))
+	require.True(t, isRetriable(&crateWriteError{rows: 1, failed: 1}))
+}
+
+// Create an endpoint failing with the given errors, before succeeding.
+func failingEndpoint(attempts *[]int, errs ...error) endpoint.Endpoint {
+	return func(ctx context.Context, request interface{}) (interface{}, error) {
+		*attempts = append(*attempts, retryAttempt(ctx))
+		if len(*attempts) <= len(errs) {
+			return nil, errs[len(*attempts)-1]
+		}
+		return "ok", nil
+	}
+}
+
+func TestRetryEndpoint(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	retriable := &pgconn.PgError{Code: "08006"}
+	permanent := &pgconn.PgError{Code: "42P01"}
+	conf := &retryPolicyConfig{
+		MaxAttempts:    3,
+		InitialBackoff: model.Duration(time.Millisecond),
+		MaxBackoff:     model.Duration(10 * time.Millisecond),
+		Budget:         model.Duration(time.Minute),
+	}
+	retry := func(ep endpoint.Endpoint) (interface{}, error) {
+		balancer := lb.NewRoundRobin(sd.FixedEndpointer{ep})
+		return newRetryPolicy(conf, "read", 1).endpoint(balancer)(context.Background(), &crateReadRequest{})
+	}
+
+	// Retriable errors are retried.
+	attempts := []int{}
+	response, err := retry(failingEndpoint(&attempts, retriable, retriable))
+	require.NoError(t, err)
+	require.Equal(t, "ok", response)
+	require.Equal(t, []int{1, 2, 3}, attempts)
+
+	// Until the maximum number of attempts is reached.
+	attempts = []int{}
+	_, err = retry(failingEndpoint(&attempts, retriable, retriable, retriable))
+	require.Equal(t, []int{1, 2, 3}, attempts)
+	var retryErr lb.RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Len(t, retryErr.RawErrors, 3)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.retriesAborted.WithLabelValues("read", retryAbortMaxAttempts)))
+
+	// Permanent errors are not retried.
+	attempts = []int{}
+	_, err = retry(failingEndpoint(&attempts, retriable, permanent))
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, permanent, retryErr.Final)
+	require.Equal(t, []int{1, 2}, attempts)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.retriesAborted.WithLabelValues("read", retryAbortPermanent)))
+
+	// Backoff delays which exceed the budget are not waited for.
+	conf.InitialBackoff = model.Duration(time.Hour)
+	conf.MaxBackoff = model.Duration(time.Hour)
+	attempts = []int{}
+	start := time.Now()
+	_, err = retry(failingEndpoint(&attempts, retriable))
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, retriable, retryErr.Final)
+	require.Less(t, time.Since(start), time.Minute)
+	require.Equal(t, []int{1}, attempts)
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.retriesAborted.WithLabelValues("read", retryAbortBudget)))
+}
+
+func TestRetryEndpointCanceled(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	conf := &retryPolicyConfig{
+		MaxAttempts:    3,
+		InitialBackoff: model.Duration(time.Millisecond),
+		MaxBackoff:     model.Duration(time.Millisecond),
+		Budget:         model.Duration(time.Minute),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	attempts := 0
+	ep := func(ctx context.Context, request interface{}) (interface{}, error) {
+		attempts++
+		cancel()
+		return nil, ctx.Err()
+	}
+	balancer := lb.NewRoundRobin(sd.FixedEndpointer{ep})
+	_, err := newRetryPolicy(conf, "write", 1).endpoint(balancer)(ctx, &crateWriteRequest{})
+	var retryErr lb.RetryError
+	require.ErrorAs(t, err, &retryErr)
+	require.Equal(t, context.Canceled, retryErr.Final)
+	require.Equal(t, 1, attempts)
+}
+
+func TestRetryAttemptMetric(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	conf := builtinConfig()
+	conf.Endpoints[0].Port = 1
+	ep, err := newCrateEndpoint(&conf.Endpoints[0])
+	require.NoError(t, err)
+	defer ep.close()
+
+	ep.endpoint()(withRetryAttempt(context.Background(), 2), &crateReadRequest{})
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.crateRetries.WithLabelValues(ep.name, "read")))
+	ep.endpoint()(context.Background(), &crateReadRequest{})
+	require.Equal(t, float64(1), testutil.ToFloat64(metrics.crateRetries.WithLabelValues(ep.name, "read")))
+}
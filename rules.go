@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/prometheus/model/exemplar"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/metadata"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/storage/remote"
+	"github.com/prometheus/prometheus/util/annotations"
+)
+
+// crateQueryable reads series from CrateDB for the PromQL engine.
+type crateQueryable struct {
+	ca *crateDbPrometheusAdapter
+}
+
+func (q *crateQueryable) Querier(mint, maxt int64) (storage.Querier, error) {
+	return &crateQuerier{ca: q.ca, mint: mint, maxt: maxt}, nil
+}
+
+type crateQuerier struct {
+	ca   *crateDbPrometheusAdapter
+	mint int64
+	maxt int64
+}
+
+func (q *crateQuerier) Select(ctx context.Context, sortSeries bool, hints *storage.SelectHints, matchers ...*labels.Matcher) storage.SeriesSet {
+	query := &prompb.Query{StartTimestampMs: q.mint, EndTimestampMs: q.maxt, Matchers: toLabelMatchers(matchers)}
+	// The hints narrow the time range down to the samples used by the query.
+	if hints != nil {
+		query.StartTimestampMs = max(hints.Start, q.mint)
+		query.EndTimestampMs = min(hints.End, q.maxt)
+	}
+	timeseries, err := q.ca.runQuery(ctx, query)
+	if err != nil {
+		return storage.ErrSeriesSet(err)
+	}
+	return remote.FromQueryResult(sortSeries, &prompb.QueryResult{Timeseries: timeseries})
+}
+
+// Label names and values are not used for evaluating rules.
+func (q *crateQuerier) LabelValues(ctx context.Context, name string, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (q *crateQuerier) LabelNames(ctx context.Context, hints *storage.LabelHints, matchers ...*labels.Matcher) ([]string, annotations.Annotations, error) {
+	return nil, nil, nil
+}
+
+func (q *crateQuerier) Close() error {
+	return nil
+}
+
+// ruleAppendable writes the results of rules to CrateDB.
+type ruleAppendable struct {
+	ca *crateDbPrometheusAdapter
+}
+
+func (r *ruleAppendable) Appender(ctx context.Context) storage.Appender {
+	return &ruleAppender{newCrateAppender(ctx, r.ca)}
+}
+
+type ruleAppender struct {
+	*crateAppender
+}
+
+func (a *ruleAppender) Append(ref storage.SeriesRef, l labels.Labels, t int64, v float64) (storage.SeriesRef, error) {
+	return a.add(l, t, v), nil
+}
+
+func (a *ruleAppender) AppendHistogram(ref storage.SeriesRef, l labels.Labels, t int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return a.dropHistogram(l), nil
+}
+
+func (a *ruleAppender) AppendHistogramSTZeroSample(ref storage.SeriesRef, l labels.Labels, t, st int64, h *histogram.Histogram, fh *histogram.FloatHistogram) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *ruleAppender) SetOptions(opts *storage.AppendOptions) {}
+
+func (a *ruleAppender) AppendExemplar(ref storage.SeriesRef, l labels.Labels, e exemplar.Exemplar) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *ruleAppender) UpdateMetadata(ref storage.SeriesRef, l labels.Labels, m metadata.Metadata) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+func (a *ruleAppender) AppendSTZeroSample(ref storage.SeriesRef, l labels.Labels, t, st int64) (storage.SeriesRef, error) {
+	return ref, nil
+}
+
+// ruleEvaluator periodically evaluates the rule groups of the `rule_files`
+// using the data stored in CrateDB, and writes the results back to CrateDB.
+// The state of alerting rules is kept in memory, persisted to CrateDB as the
+// `ALERTS` and `ALERTS_FOR_STATE` series, and restored from them on startup.
+type ruleEvaluator struct {
+	manager     *rules.Manager
+	notifier    *alertmanagerNotifier
+	patterns    []string
+	interval    time.Duration
+	externalURL string
+	cancel      context.CancelFunc
+}
+
+func newRuleEvaluator(conf *config, ca *crateDbPrometheusAdapter, registerer prometheus.Registerer) (*ruleEvaluator, error) {
+	queryable := &crateQueryable{ca: ca}
+	engine := promql.NewEngine(promql.EngineOpts{
+		Logger:     logger,
+		Reg:        registerer,
+		MaxSamples: 50000000,
+		Timeout:    2 * time.Minute,
+	})
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &ruleEvaluator{
+		patterns:    conf.RuleFiles,
+		interval:    time.Duration(conf.EvaluationInterval),
+		externalURL: conf.Alerting.ExternalURL,
+		cancel:      cancel,
+	}
+	// Without Alertmanagers, alerting rules are only evaluated and persisted.
+	notify := func(ctx context.Context, expr string, alerts ...*rules.Alert) {}
+	if len(conf.Alerting.Alertmanagers) > 0 {
+		r.notifier = newAlertmanagerNotifier(&conf.Alerting)
+		notify = rules.SendAlerts(r.notifier, r.externalURL)
+	}
+	opts := &rules.ManagerOptions{
+		Appendable:      &ruleAppendable{ca: ca},
+		Queryable:       queryable,
+		QueryFunc:       rules.EngineQueryFunc(engine, queryable),
+		NotifyFunc:      notify,
+		Context:         ctx,
+		Logger:          logger,
+		Registerer:      registerer,
+		OutageTolerance: time.Duration(conf.Alerting.OutageTolerance),
+		ForGracePeriod:  time.Duration(conf.Alerting.ForGracePeriod),
+		ResendDelay:     time.Duration(conf.Alerting.ResendDelay),
+	}
+	if r.externalURL != "" {
+		// The URL has already been validated with the configuration.
+		opts.ExternalURL, _ = url.Parse(r.externalURL)
+	}
+	r.manager = rules.NewManager(opts)
+	if err := r.reload(); err != nil {
+		cancel()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Load the rule files, replacing the rule groups which have changed.
+func (r *ruleEvaluator) reload() error {
+	var files []string
+	for _, pattern := range r.patterns {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid rule files pattern %q: %v", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	// Load the groups first, as errors are only logged when updating them.
+	if _, errs := r.manager.LoadGroups(r.interval, labels.EmptyLabels(), r.externalURL, nil, false, files...); len(errs) > 0 {
+		return fmt.Errorf("error loading rules: %v", errs[0])
+	}
+	return r.manager.Update(r.interval, files, labels.EmptyLabels(), r.externalURL, nil)
+}
+
+func (r *ruleEvaluator) run() {
+	if r.notifier != nil {
+		r.notifier.run()
+	}
+	go r.manager.Run()
+}
+
+// Stop evaluating rules, waiting for running evaluations to finish and for
+// the pending alerts to be sent.
+func (r *ruleEvaluator) stop() {
+	r.manager.Stop()
+	r.cancel()
+	if r.notifier != nil {
+		r.notifier.stop()
+	}
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/notifier"
+	"github.com/prometheus/prometheus/rules"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+	"github.com/stretchr/testify/require"
+)
+
+// Create an adapter reading the given rows, and recording the written rows.
+func ruleTestAdapter(readRows []*crateRow) (*crateDbPrometheusAdapter, *[]string, func() []*crateRow) {
+	var mtx sync.Mutex
+	stmts := []string{}
+	written := []*crateRow{}
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			switch r := request.(type) {
+			case *crateReadRequest:
+				stmts = append(stmts, r.stmt)
+				// Only the rows of the selected metric are returned.
+				rows := []*crateRow{}
+				for _, row := range readRows {
+					if strings.Contains(r.stmt, fmt.Sprintf("(labels['__name__'] = '%s')", row.labels["__name__"])) {
+						rows = append(rows, row)
+					}
+				}
+				return &crateReadResponse{rows: rows}, nil
+			case *crateWriteRequest:
+				written = append(written, r.rows...)
+			}
+			return nil, nil
+		},
+	}
+	return ca, &stmts, func() []*crateRow {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return append([]*crateRow{}, written...)
+	}
+}
+
+func writeRuleFile(t *testing.T, content string) string {
+	filename := filepath.Join(t.TempDir(), "rules.yml")
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o644))
+	return filename
+}
+
+func TestCrateQuerier(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	ca, stmts, _ := ruleTestAdapter([]*crateRow{
+		testRow(model.Metric{"__name__": "up", "job": "prometheus"}, time.Minute, 1),
+		testRow(model.Metric{"__name__": "up", "job": "node"}, time.Minute, 0),
+		testRow(model.Metric{"__name__": "up", "job": "node"}, 2*time.Minute, 1),
+	})
+	querier, err := (&crateQueryable{ca: ca}).Querier(0, time.Hour.Milliseconds())
+	require.NoError(t, err)
+	defer querier.Close()
+
+	hints := &storage.SelectHints{Start: time.Minute.Milliseconds(), End: 2 * time.Minute.Milliseconds()}
+	set := querier.Select(context.Background(), true, hints, labels.MustNewMatcher(labels.MatchEqual, "__name__", "up"))
+	series := map[string][]float64{}
+	for set.Next() {
+		it := set.At().Iterator(nil)
+		for it.Next() == chunkenc.ValFloat {
+			_, v := it.At()
+			series[set.At().Labels().String()] = append(series[set.At().Labels().String()], v)
+		}
+	}
+	require.NoError(t, set.Err())
+	require.Equal(t, map[string][]float64{`{__name__="up", job="node"}`: {0, 1}, `{__name__="up", job="prometheus"}`: {1}}, series)
+
+	// The time range is narrowed down by the hints.
+	require.Len(t, *stmts, 1)
+	require.Contains(t, (*stmts)[0], "(timestamp <= 120000) AND (timestamp >= 60000)")
+	require.Contains(t, (*stmts)[0], "(labels['__name__'] = 'up')")
+}
+
+func TestRuleEvaluation(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	now := time.Now().Truncate(time.Second)
+	ago := time.Duration(now.Add(-30 * time.Second).UnixNano())
+	ca, _, written := ruleTestAdapter([]*crateRow{
+		testRow(model.Metric{"__name__": "up", "job": "node", "instance": "a"}, ago, 1),
+		testRow(model.Metric{"__name__": "up", "job": "node", "instance": "b"}, ago, 1),
+		testRow(model.Metric{"__name__": "up", "job": "prometheus", "instance": "c"}, ago, 0),
+	})
+
+	conf := &config{
+		RuleFiles: []string{writeRuleFile(t, `groups:
+- name: availability
+  rules:
+  - record: job:up:sum
+    expr: sum by (job) (up)
+`)},
+		EvaluationInterval: model.Duration(time.Minute),
+	}
+	r, err := newRuleEvaluator(conf, ca, prometheus.NewRegistry())
+	require.NoError(t, err)
+	// The groups are evaluated explicitly, without running the manager.
+	defer r.cancel()
+
+	groups := r.manager.RuleGroups()
+	require.Len(t, groups, 1)
+	require.Equal(t, time.Minute, groups[0].Interval())
+	groups[0].Eval(context.Background(), now)
+
+	results := map[string]float64{}
+	for _, row := range written() {
+		require.Equal(t, now.UnixMilli(), row.timestamp.UnixMilli())
+		results[row.labels.String()] = row.value
+	}
+	require.Equal(t, map[string]float64{`job:up:sum{job="node"}`: 2, `job:up:sum{job="prometheus"}`: 0}, results)
+}
+
+func TestRuleEvaluatorInvalid(t *testing.T) {
+	ca, _, _ := ruleTestAdapter(nil)
+	for _, content := range []string{
+		"groups:\n- name: a\n  rules:\n  - record: a\n    expr: sum(\n",
+		"groups:\n- name: a\n  rules:\n  - alert: Down\n    expr: up == 0\n    for: 1h 5m\n",
+	} {
+		conf := &config{RuleFiles: []string{writeRuleFile(t, content)}, EvaluationInterval: model.Duration(time.Minute)}
+		_, err := newRuleEvaluator(conf, ca, prometheus.NewRegistry())
+		require.Error(t, err, content)
+	}
+}
+
+const diskFullRules = `groups:
+- name: capacity
+  rules:
+  - alert: DiskFull
+    expr: disk_free_bytes < 100
+    for: 15m
+    labels:
+      severity: warning
+    annotations:
+      summary: "{{ $labels.instance }} is running out of disk space"
+`
+
+// Rows of a disk which is full, sampled every minute around the given time.
+func diskFullRows(t0 time.Time) []*crateRow {
+	rows := []*crateRow{}
+	for ts := t0.Add(-time.Minute); !ts.After(t0.Add(20 * time.Minute)); ts = ts.Add(time.Minute) {
+		rows = append(rows, testRow(model.Metric{"__name__": "disk_free_bytes", "instance": "db1"}, time.Duration(ts.UnixNano()), 50))
+	}
+	return rows
+}
+
+func alertingTestConfig(t *testing.T, alertmanagers ...string) *config {
+	conf := &config{
+		RuleFiles:          []string{writeRuleFile(t, diskFullRules)},
+		EvaluationInterval: model.Duration(time.Minute),
+		Alerting:           alertingConfig{Alertmanagers: alertmanagers, ExternalURL: "http://adapter.example.com"},
+	}
+	conf.Alerting.setDefaults()
+	return conf
+}
+
+func TestAlertingRuleEvaluation(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	// A local stand-in for the Alertmanager.
+	var mtx sync.Mutex
+	received := []*notifier.Alert{}
+	alertmanager := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/api/v2/alerts", r.URL.Path)
+		var alerts []*notifier.Alert
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&alerts))
+		mtx.Lock()
+		defer mtx.Unlock()
+		received = append(received, alerts...)
+	}))
+	defer alertmanager.Close()
+
+	t0 := time.Now().Truncate(time.Minute).Add(-time.Hour)
+	ca, _, written := ruleTestAdapter(diskFullRows(t0))
+	r, err := newRuleEvaluator(alertingTestConfig(t, alertmanager.URL), ca, prometheus.NewRegistry())
+	require.NoError(t, err)
+	defer r.cancel()
+	r.notifier.run()
+
+	group := r.manager.RuleGroups()[0]
+	// Alerts are only persisted after restoring their state, which finds none.
+	group.RestoreForState(t0)
+	// The alert is pending until it has been active for 15 minutes.
+	group.Eval(context.Background(), t0)
+	group.Eval(context.Background(), t0.Add(15*time.Minute))
+	r.notifier.stop()
+
+	require.Len(t, received, 1)
+	require.Equal(t, labels.FromStrings("alertname", "DiskFull", "instance", "db1", "severity", "warning"), received[0].Labels)
+	require.Equal(t, "db1 is running out of disk space", received[0].Annotations.Get("summary"))
+	require.Equal(t, t0.Add(15*time.Minute).UnixMilli(), received[0].StartsAt.UnixMilli())
+	require.True(t, strings.HasPrefix(received[0].GeneratorURL, "http://adapter.example.com/graph?"), received[0].GeneratorURL)
+
+	// The state of the alert is persisted to CrateDB, and the pending series
+	// is marked as stale.
+	results := []string{}
+	for _, row := range written() {
+		results = append(results, fmt.Sprintf("%s %d %.0f", row.labels, row.timestamp.Sub(t0)/time.Minute, row.value))
+	}
+	require.ElementsMatch(t, []string{
+		fmt.Sprintf(`ALERTS_FOR_STATE{alertname="DiskFull", instance="db1", severity="warning"} 0 %d`, t0.Unix()),
+		`ALERTS{alertname="DiskFull", alertstate="pending", instance="db1", severity="warning"} 0 1`,
+		fmt.Sprintf(`ALERTS_FOR_STATE{alertname="DiskFull", instance="db1", severity="warning"} 15 %d`, t0.Unix()),
+		`ALERTS{alertname="DiskFull", alertstate="firing", instance="db1", severity="warning"} 15 1`,
+		`ALERTS{alertname="DiskFull", alertstate="pending", instance="db1", severity="warning"} 15 NaN`,
+	}, results)
+}
+
+func TestAlertingRuleRestore(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	t0 := time.Now().Truncate(time.Minute).Add(-time.Hour)
+	ca, _, written := ruleTestAdapter(diskFullRows(t0))
+	r, err := newRuleEvaluator(alertingTestConfig(t), ca, prometheus.NewRegistry())
+	require.NoError(t, err)
+	defer r.cancel()
+	group := r.manager.RuleGroups()[0]
+	group.RestoreForState(t0)
+	group.Eval(context.Background(), t0)
+	group.Eval(context.Background(), t0.Add(15*time.Minute))
+
+	// After a restart, the state of the firing alert is restored from CrateDB.
+	ca, _, _ = ruleTestAdapter(append(diskFullRows(t0), written()...))
+	r, err = newRuleEvaluator(alertingTestConfig(t), ca, prometheus.NewRegistry())
+	require.NoError(t, err)
+	defer r.cancel()
+	group = r.manager.RuleGroups()[0]
+	group.Eval(context.Background(), t0.Add(16*time.Minute))
+	group.RestoreForState(t0.Add(16 * time.Minute))
+	group.Eval(context.Background(), t0.Add(17*time.Minute))
+
+	alerts := group.Rules()[0].(*rules.AlertingRule).ActiveAlerts()
+	require.Len(t, alerts, 1)
+	require.Equal(t, rules.StateFiring, alerts[0].State)
+	require.Equal(t, t0.Unix(), alerts[0].ActiveAt.Unix())
+}
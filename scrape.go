@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/prometheus/client_golang/prometheus"
+	promconfig "github.com/prometheus/prometheus/config"
+	"github.com/prometheus/prometheus/discovery"
+	_ "github.com/prometheus/prometheus/discovery/file" // Register file_sd_configs.
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/scrape"
+	"github.com/prometheus/prometheus/storage"
+	"gopkg.in/yaml.v2"
+)
+
+// scrapeConfigs holds the `scrape_configs` section. It is loaded as Prometheus
+// configuration, so that its defaults and validation apply.
+type scrapeConfigs struct {
+	prom *promconfig.Config
+}
+
+func (s *scrapeConfigs) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw []interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	// Load the section from its source, so that secrets are retained.
+	content, err := yaml.Marshal(map[string]interface{}{"scrape_configs": raw})
+	if err != nil {
+		return err
+	}
+	if s.prom, err = promconfig.Load(string(content), logger); err != nil {
+		return fmt.Errorf("invalid scrape configs: %v", err)
+	}
+	return nil
+}
+
+func (s *scrapeConfigs) MarshalYAML() (interface{}, error) {
+	return s.prom.ScrapeConfigs, nil
+}
+
+// Resolve relative paths, like of `file_sd_configs`, against the directory of
+// the configuration file.
+func (s *scrapeConfigs) setDirectory(filename string) {
+	s.prom.SetDirectory(filepath.Dir(filename))
+}
+
+// scrapeAppendable writes scraped samples to CrateDB.
+type scrapeAppendable struct {
+	ca *crateDbPrometheusAdapter
+}
+
+func (s *scrapeAppendable) AppenderV2(ctx context.Context) storage.AppenderV2 {
+	return &scrapeAppender{newCrateAppender(ctx, s.ca)}
+}
+
+type scrapeAppender struct {
+	*crateAppender
+}
+
+func (a *scrapeAppender) Append(ref storage.SeriesRef, ls labels.Labels, st, t int64, v float64, h *histogram.Histogram, fh *histogram.FloatHistogram, opts storage.AOptions) (storage.SeriesRef, error) {
+	if h != nil || fh != nil {
+		return a.dropHistogram(ls), nil
+	}
+	return a.add(ls, t, v), nil
+}
+
+// scraper scrapes the targets of the `scrape_configs`, discovered using
+// static or file based service discovery, and writes the samples to CrateDB.
+type scraper struct {
+	discovery *discovery.Manager
+	scrape    *scrape.Manager
+	cancel    context.CancelFunc
+}
+
+func newScraper(conf *scrapeConfigs, ca *crateDbPrometheusAdapter, opts *scrape.Options, registerer prometheus.Registerer) (*scraper, error) {
+	sdMetrics, err := discovery.CreateAndRegisterSDMetrics(registerer)
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	discoveryManager := discovery.NewManager(ctx, logger, registerer, sdMetrics)
+	if discoveryManager == nil {
+		cancel()
+		return nil, fmt.Errorf("error creating service discovery")
+	}
+	scrapeManager, err := scrape.NewManager(opts, logger, nil, nil, &scrapeAppendable{ca: ca}, registerer)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	if err := scrapeManager.ApplyConfig(conf.prom); err != nil {
+		cancel()
+		return nil, err
+	}
+	discoveryConfigs := map[string]discovery.Configs{}
+	for _, sc := range conf.prom.ScrapeConfigs {
+		discoveryConfigs[sc.JobName] = sc.ServiceDiscoveryConfigs
+	}
+	if err := discoveryManager.ApplyConfig(discoveryConfigs); err != nil {
+		cancel()
+		return nil, err
+	}
+	return &scraper{discovery: discoveryManager, scrape: scrapeManager, cancel: cancel}, nil
+}
+
+func (s *scraper) run() {
+	go func() {
+		if err := s.discovery.Run(); err != nil {
+			logger.Error("Service discovery failed", "err", err)
+		}
+	}()
+	go func() {
+		if err := s.scrape.Run(s.discovery.SyncCh()); err != nil {
+			logger.Error("Scraping failed", "err", err)
+		}
+	}()
+}
+
+// Stop scraping, waiting for running scrapes to finish.
+func (s *scraper) stop() {
+	s.cancel()
+	s.scrape.Stop()
+}
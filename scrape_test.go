@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/discovery/file"
+	"github.com/prometheus/prometheus/model/histogram"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/scrape"
+	"github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func writeScrapeConfig(t *testing.T, scrapeConfigs string) string {
+	filename := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(filename, []byte("cratedb_endpoints:\n- host: localhost\n"+scrapeConfigs), 0o644))
+	return filename
+}
+
+func TestLoadScrapeConfigs(t *testing.T) {
+	filename := writeScrapeConfig(t, `scrape_configs:
+- job_name: node
+  basic_auth:
+    username: scraper
+    password: secret
+  static_configs:
+  - targets: [localhost:9100]
+- job_name: devices
+  scrape_interval: 15s
+  file_sd_configs:
+  - files: [targets/*.json]
+`)
+	conf, err := loadConfig(filename)
+	require.NoError(t, err)
+	require.NotNil(t, conf.ScrapeConfigs)
+	scrapeConfigs := conf.ScrapeConfigs.prom.ScrapeConfigs
+	require.Len(t, scrapeConfigs, 2)
+
+	// Defaults of Prometheus apply, and secrets are retained.
+	require.Equal(t, model.Duration(time.Minute), scrapeConfigs[0].ScrapeInterval)
+	require.Equal(t, model.Duration(10*time.Second), scrapeConfigs[0].ScrapeTimeout)
+	require.Equal(t, "secret", string(scrapeConfigs[0].HTTPClientConfig.BasicAuth.Password))
+	require.Equal(t, model.Duration(15*time.Second), scrapeConfigs[1].ScrapeInterval)
+
+	// Relative paths are resolved against the directory of the configuration file.
+	fileSD := scrapeConfigs[1].ServiceDiscoveryConfigs[0].(*file.SDConfig)
+	require.Equal(t, []string{filepath.Join(filepath.Dir(filename), "targets/*.json")}, fileSD.Files)
+
+	// Scrape configs are optional.
+	conf, err = loadConfig(writeScrapeConfig(t, ""))
+	require.NoError(t, err)
+	require.Nil(t, conf.ScrapeConfigs)
+
+	for _, scrapeConfigs := range []string{
+		"scrape_configs:\n- static_configs: [{targets: [localhost:9100]}]\n",
+		"scrape_configs:\n- job_name: a\n- job_name: a\n",
+		"scrape_configs:\n- job_name: a\n  consul_sd_configs: [{server: localhost:8500}]\n",
+	} {
+		_, err := loadConfig(writeScrapeConfig(t, scrapeConfigs))
+		require.Error(t, err, scrapeConfigs)
+	}
+}
+
+func TestScrapeAppender(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	rows := []*crateRow{}
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			rows = append(rows, request.(*crateWriteRequest).rows...)
+			return nil, nil
+		},
+	}
+	app := (&scrapeAppendable{ca: ca}).AppenderV2(context.Background())
+	up := labels.FromStrings("__name__", "up", "job", "node")
+	_, err := app.Append(0, up, 0, 1000, 1, nil, nil, storage.AOptions{})
+	require.NoError(t, err)
+	_, err = app.Append(0, labels.FromStrings("__name__", "latency"), 0, 1000, 0, &histogram.Histogram{}, nil, storage.AOptions{})
+	require.NoError(t, err)
+	require.NoError(t, app.Rollback())
+	_, err = app.Append(0, up, 0, 2000, 1, nil, nil, storage.AOptions{})
+	require.NoError(t, err)
+	require.NoError(t, app.Commit())
+
+	// Only the sample appended after the rollback is written.
+	require.Len(t, rows, 1)
+	require.Equal(t, model.Metric{"__name__": "up", "job": "node"}, rows[0].labels)
+	require.Equal(t, int64(2000), rows[0].timestamp.UnixMilli())
+
+	// Nothing is written without samples.
+	require.NoError(t, app.Commit())
+	require.Len(t, rows, 1)
+}
+
+func TestScraper(t *testing.T) {
+	setupMetrics(defaultMetricsPrefix, false)
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "# TYPE temperature_celsius gauge")
+		fmt.Fprintln(w, `temperature_celsius{sensor="a"} 21.5`)
+	}))
+	defer target.Close()
+	targetURL, err := url.Parse(target.URL)
+	require.NoError(t, err)
+
+	var mtx sync.Mutex
+	written := map[string]float64{}
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			mtx.Lock()
+			defer mtx.Unlock()
+			for _, row := range request.(*crateWriteRequest).rows {
+				written[row.labels.String()] = row.value
+			}
+			return nil, nil
+		},
+	}
+
+	conf, err := loadConfig(writeScrapeConfig(t, fmt.Sprintf(`scrape_configs:
+- job_name: sensors
+  scrape_interval: 100ms
+  scrape_timeout: 100ms
+  static_configs:
+  - targets: [%s]
+`, targetURL.Host)))
+	require.NoError(t, err)
+	s, err := newScraper(conf.ScrapeConfigs, ca, &scrape.Options{DiscoveryReloadOnStartup: true}, prometheus.NewRegistry())
+	require.NoError(t, err)
+	s.run()
+	defer s.stop()
+
+	instance := targetURL.Host
+	require.Eventually(t, func() bool {
+		mtx.Lock()
+		defer mtx.Unlock()
+		return written[fmt.Sprintf(`temperature_celsius{instance="%s", job="sensors", sensor="a"}`, instance)] == 21.5 &&
+			written[fmt.Sprintf(`up{instance="%s", job="sensors"}`, instance)] == 1
+	}, 10*time.Second, 50*time.Millisecond)
+}
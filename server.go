@@ -9,19 +9,26 @@ import (
 	slog "log/slog"
 	"math"
 	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
 	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"github.com/go-kit/kit/endpoint"
-	"github.com/go-kit/kit/sd"
-	"github.com/go-kit/kit/sd/lb"
 	"github.com/golang/snappy"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	config_util "github.com/prometheus/common/config"
 	"github.com/prometheus/common/model"
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/model/relabel"
 	"github.com/prometheus/prometheus/prompb"
+	"github.com/prometheus/prometheus/scrape"
 	yaml "gopkg.in/yaml.v2"
 )
 
@@ -30,50 +37,13 @@ const version = "0.5.14"
 var (
 	listenAddress       = flag.String("web.listen-address", ":9268", "Address to listen on for Prometheus requests.")
 	configFile          = flag.String("config.file", "", "Path to the CrateDB endpoints configuration file.")
-	metricsExportPrefix = flag.String("metrics.export.prefix", "cratedb_prometheus_adapter_", "Prefix for exported CrateDB metrics.")
+	webConfigFile       = flag.String("web.config.file", "", "Path to the configuration file that can enable TLS or authentication.")
+	metricsExportPrefix = flag.String("metrics.export.prefix", defaultMetricsPrefix, "Prefix for exported CrateDB metrics.")
+	shutdownDelay       = flag.Duration("web.shutdown-delay", 0, "How long to report not-ready before draining requests on shutdown.")
+	shutdownTimeout     = flag.Duration("web.shutdown-timeout", 30*time.Second, "How long to wait for in-flight requests to finish on shutdown.")
+	metricsLegacyNames  = flag.Bool("metrics.legacy-names", false, "Also export self-metrics using their legacy names, like `write_crate_latency_seconds`.")
 	makeConfig          = flag.Bool("config.make", false, "Print configuration file blueprint to stdout.")
 	printVersion        = flag.Bool("version", false, "Print version information.")
-
-	writeDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: fmt.Sprintf("%swrite_latency_seconds", *metricsExportPrefix),
-		Help: "How long it took to respond to write requests.",
-	})
-	writeErrors = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%swrite_failed_total", *metricsExportPrefix),
-		Help: "How many write request returned errors.",
-	})
-	writeSamples = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name: fmt.Sprintf("%swrite_timeseries_samples", *metricsExportPrefix),
-		Help: "How many samples each written timeseries has.",
-	})
-	writeCrateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: fmt.Sprintf("%swrite_crate_latency_seconds", *metricsExportPrefix),
-		Help: "Latency for inserts to CrateDB.",
-	})
-	writeCrateErrors = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%swrite_crate_failed_total", *metricsExportPrefix),
-		Help: "How many inserts to CrateDB failed.",
-	})
-	readDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: fmt.Sprintf("%sread_latency_seconds", *metricsExportPrefix),
-		Help: "How long it took to respond to read requests.",
-	})
-	readErrors = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%sread_failed_total", *metricsExportPrefix),
-		Help: "How many read requests returned errors.",
-	})
-	readCrateDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
-		Name: fmt.Sprintf("%sread_crate_latency_seconds", *metricsExportPrefix),
-		Help: "Latency for selects from CrateDB.",
-	})
-	readCrateErrors = prometheus.NewCounter(prometheus.CounterOpts{
-		Name: fmt.Sprintf("%sread_crate_failed_total", *metricsExportPrefix),
-		Help: "How many selects from CrateDB failed.",
-	})
-	readSamples = prometheus.NewSummary(prometheus.SummaryOpts{
-		Name: fmt.Sprintf("%sread_timeseries_samples", *metricsExportPrefix),
-		Help: "How many samples each returned timeseries has.",
-	})
 )
 
 // Module-wide `logger` variable, initialized by `setupLogging()`.
@@ -81,16 +51,7 @@ var logger *slog.Logger
 
 func init() {
 	setupLogging()
-	prometheus.MustRegister(writeDuration)
-	prometheus.MustRegister(writeErrors)
-	prometheus.MustRegister(writeSamples)
-	prometheus.MustRegister(writeCrateDuration)
-	prometheus.MustRegister(writeCrateErrors)
-	prometheus.MustRegister(readDuration)
-	prometheus.MustRegister(readErrors)
-	prometheus.MustRegister(readSamples)
-	prometheus.MustRegister(readCrateDuration)
-	prometheus.MustRegister(readCrateErrors)
+	setupMetrics(defaultMetricsPrefix, false)
 	logger.Info("Initialized CrateDB Prometheus Adapter", "version", version)
 }
 
@@ -199,41 +160,106 @@ func responseToTimeseries(data *crateReadResponse) []*prompb.TimeSeries {
 	sort.Strings(names)
 	resp := make([]*prompb.TimeSeries, 0, len(timeseries))
 	for _, name := range names {
-		readSamples.Observe(float64(len(timeseries[name].Samples)))
+		metrics.observeSamples("read", len(timeseries[name].Samples))
 		resp = append(resp, timeseries[name])
 	}
 	return resp
 }
 
 type crateDbPrometheusAdapter struct {
-	ep endpoint.Endpoint
+	ep                  endpoint.Endpoint
+	cardinality         *cardinalityTracker
+	queryStats          *queryStats
+	queryCache          *queryCache
+	writeRelabelConfigs []*relabel.Config
 }
 
-func (ca *crateDbPrometheusAdapter) runQuery(q *prompb.Query) ([]*prompb.TimeSeries, error) {
+func (ca *crateDbPrometheusAdapter) runQuery(ctx context.Context, q *prompb.Query) (timeseries []*prompb.TimeSeries, err error) {
+	ctx, span := startSpan(ctx, "runQuery")
+	defer func() { endSpan(span, err) }()
+
+	// Record the statistics once per query, also when the query cache splits
+	// it into several queries against CrateDB.
+	start := time.Now()
+	rows := 0
+	if ca.queryStats != nil {
+		defer func() {
+			stmt, _ := queryToSQL(q)
+			ca.queryStats.record(q, stmt, rows, len(timeseries), time.Since(start), err)
+		}()
+	}
+
+	run := func(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, error) {
+		timeseries, n, err := ca.queryCrate(ctx, q)
+		rows += n
+		return timeseries, err
+	}
+	if ca.queryCache != nil {
+		return ca.queryCache.query(ctx, q, run)
+	}
+	return run(ctx, q)
+}
+
+// queryCrate runs a read query against CrateDB, bypassing the query cache.
+// It returns the number of rows read besides the series.
+func (ca *crateDbPrometheusAdapter) queryCrate(ctx context.Context, q *prompb.Query) ([]*prompb.TimeSeries, int, error) {
+	_, sqlSpan := startSpan(ctx, "queryToSQL")
 	query, err := queryToSQL(q)
+	endSpan(sqlSpan, err)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
 	logger.Debug("runQuery", "stmt", query)
 	request := &crateReadRequest{stmt: query}
 
-	timer := prometheus.NewTimer(readCrateDuration)
-	result, err := ca.ep(context.Background(), request)
-	timer.ObserveDuration()
+	result, err := ca.ep(ctx, request)
 	if err != nil {
-		readCrateErrors.Inc()
-		return nil, err
+		return nil, 0, err
 	}
-	return responseToTimeseries(result.(*crateReadResponse)), nil
+	response := result.(*crateReadResponse)
+	return responseToTimeseries(response), len(response.rows), nil
+}
+
+// Header to limit the time spent on a remote read request. Prometheus does not
+// send it by default, but it can be configured using the `headers` setting
+// of `remote_read`.
+const remoteReadTimeoutHeader = "X-Prometheus-Remote-Read-Timeout"
+
+// Parse a timeout given either in seconds, or as a Prometheus duration like `30s`.
+func parseTimeout(s string) (time.Duration, error) {
+	if seconds, err := strconv.ParseFloat(s, 64); err == nil {
+		if seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+			return 0, fmt.Errorf("invalid timeout %q", s)
+		}
+		return time.Duration(seconds * float64(time.Second)), nil
+	}
+	d, err := model.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid timeout %q", s)
+	}
+	return time.Duration(d), nil
 }
 
 func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(readDuration)
-	defer timer.ObserveDuration()
+	// The context is canceled when the client disconnects, which cancels the query.
+	ctx := r.Context()
+	if s := r.Header.Get(remoteReadTimeoutHeader); s != "" {
+		timeout, err := parseTimeout(s)
+		if err != nil {
+			logger.Error("Failed to parse timeout header", "err", err)
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
 
+	_, span := startSpan(ctx, "decode request")
 	compressed, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to read body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -241,6 +267,7 @@ func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Re
 
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to decompress body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -248,10 +275,12 @@ func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Re
 
 	var req prompb.ReadRequest
 	if err := req.Unmarshal(reqBuf); err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to unmarshal body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	endSpan(span, nil)
 
 	if len(req.Queries) != 1 {
 		logger.Error("More than one query sent")
@@ -259,12 +288,23 @@ func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Re
 		return
 	}
 
-	result, err := ca.runQuery(req.Queries[0])
+	result, err := ca.runQuery(ctx, req.Queries[0])
+	if err != nil && ctx.Err() == context.Canceled {
+		logger.Debug("Client disconnected, canceled select against CrateDB", "err", err)
+		return
+	}
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		logger.Warn("Timeout running select against CrateDB", "err", err)
+		http.Error(w, err.Error(), http.StatusGatewayTimeout)
+		return
+	}
 	if err != nil {
 		logger.Warn("Failed to run select against CrateDB", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+
+	_, span = startSpan(ctx, "encode response")
 	resp := prompb.ReadResponse{
 		Results: []*prompb.QueryResult{
 			{Timeseries: result},
@@ -272,6 +312,7 @@ func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Re
 	}
 	data, err := resp.Marshal()
 	if err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to marshal response", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -279,13 +320,32 @@ func (ca *crateDbPrometheusAdapter) handleRead(w http.ResponseWriter, r *http.Re
 
 	w.Header().Set("Content-Type", "application/x-protobuf")
 	if _, err := w.Write(snappy.Encode(nil, data)); err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to compress response", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	endSpan(span, nil)
 }
 
-func writesToCrateRequest(req *prompb.WriteRequest) *crateWriteRequest {
+// Apply write relabeling rules to the labels of a series.
+// Returns nil when the series should be dropped.
+func relabelMetric(metric model.Metric, cfgs []*relabel.Config) model.Metric {
+	lb := labels.NewBuilder(labels.EmptyLabels())
+	for k, v := range metric {
+		lb.Set(string(k), string(v))
+	}
+	if !relabel.ProcessBuilder(lb, cfgs...) {
+		return nil
+	}
+	result := model.Metric{}
+	lb.Range(func(l labels.Label) {
+		result[model.LabelName(l.Name)] = model.LabelValue(l.Value)
+	})
+	return result
+}
+
+func writesToCrateRequest(req *prompb.WriteRequest, relabelConfigs []*relabel.Config) *crateWriteRequest {
 	request := &crateWriteRequest{
 		rows: make([]*crateRow, 0, len(req.Timeseries)),
 	}
@@ -295,6 +355,14 @@ func writesToCrateRequest(req *prompb.WriteRequest) *crateWriteRequest {
 		for _, l := range ts.Labels {
 			metric[model.LabelName(l.Name)] = model.LabelValue(l.Value)
 		}
+		// Relabel before fingerprinting, so that `labels_hash` reflects the final label set.
+		if len(relabelConfigs) > 0 {
+			metric = relabelMetric(metric, relabelConfigs)
+			if metric == nil {
+				metrics.dropSamples("relabel", len(ts.Samples))
+				continue
+			}
+		}
 		fp := metric.Fingerprint().String()
 
 		for _, s := range ts.Samples {
@@ -308,17 +376,19 @@ func writesToCrateRequest(req *prompb.WriteRequest) *crateWriteRequest {
 				valueRaw: int64(math.Float64bits(s.Value)),
 			})
 		}
-		writeSamples.Observe(float64(len(ts.Samples)))
+		metrics.observeSamples("write", len(ts.Samples))
 	}
 	return request
 }
 
 func (ca *crateDbPrometheusAdapter) handleWrite(w http.ResponseWriter, r *http.Request) {
-	timer := prometheus.NewTimer(writeDuration)
-	defer timer.ObserveDuration()
+	// The context is canceled when the client disconnects, which cancels the write.
+	ctx := r.Context()
 
+	_, span := startSpan(ctx, "decode request")
 	compressed, err := ioutil.ReadAll(r.Body)
 	if err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to read body", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -326,6 +396,7 @@ func (ca *crateDbPrometheusAdapter) handleWrite(w http.ResponseWriter, r *http.R
 
 	reqBuf, err := snappy.Decode(nil, compressed)
 	if err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to decompress body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
@@ -333,18 +404,50 @@ func (ca *crateDbPrometheusAdapter) handleWrite(w http.ResponseWriter, r *http.R
 
 	var req prompb.WriteRequest
 	if err := req.Unmarshal(reqBuf); err != nil {
+		endSpan(span, err)
 		logger.Error("Failed to unmarshal body", "err", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	endSpan(span, nil)
+
+	_, span = startSpan(ctx, "convert timeseries")
+	request := writesToCrateRequest(&req, ca.writeRelabelConfigs)
+	if ca.cardinality != nil {
+		request = ca.cardinality.filter(request)
+	}
+	endSpan(span, nil)
 
-	request := writesToCrateRequest(&req)
+	ca.writeRows(ctx, w, request)
+}
+
+// Write rows to CrateDB, invalidating the cached query results of the days
+// which are written to. All write paths of the adapter must write using this.
+func (ca *crateDbPrometheusAdapter) write(ctx context.Context, request *crateWriteRequest) error {
+	_, err := ca.ep(ctx, request)
+	// Also when failing, as some of the rows may have been written.
+	if ca.queryCache != nil {
+		ca.queryCache.invalidate(request.rows)
+	}
+	return err
+}
 
-	writeTimer := prometheus.NewTimer(writeCrateDuration)
-	_, err = ca.ep(context.Background(), request)
-	writeTimer.ObserveDuration()
+// Write rows to CrateDB, and respond with the outcome.
+func (ca *crateDbPrometheusAdapter) writeRows(ctx context.Context, w http.ResponseWriter, request *crateWriteRequest) {
+	err := ca.write(ctx, request)
+	if err != nil && ctx.Err() == context.Canceled {
+		logger.Debug("Client disconnected, canceled write to CrateDB", "err", err)
+		return
+	}
+	if writeErr, ok := asWriteError(err); ok && writeErr.permanent {
+		// Prometheus does not retry requests failing with 4xx status codes,
+		// which would fail again anyway.
+		metrics.dropSamples(writeErr.reason, writeErr.failed)
+		logger.Error("Failed to write data to CrateDB, dropping samples", "err", err, "samples", writeErr.failed)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		writeCrateErrors.Inc()
 		logger.Error("Failed to write data to CrateDB", "err", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -352,38 +455,66 @@ func (ca *crateDbPrometheusAdapter) handleWrite(w http.ResponseWriter, r *http.R
 }
 
 type endpointConfig struct {
-	Host             string `yaml:"host"`
-	Port             uint16 `yaml:"port"`
-	User             string `yaml:"user"`
-	Password         string `yaml:"password"`
-	Schema           string `yaml:"schema"`
-	MaxConnections   int    `yaml:"max_connections"`
-	ReadPoolSize     int    `yaml:"read_pool_size_max"`
-	WritePoolSize    int    `yaml:"write_pool_size_max"`
-	ConnectTimeout   int    `yaml:"connect_timeout"`
-	ReadTimeout      int    `yaml:"read_timeout"`
-	WriteTimeout     int    `yaml:"write_timeout"`
-	EnableTLS        bool   `yaml:"enable_tls"`
-	AllowInsecureTLS bool   `yaml:"allow_insecure_tls"`
+	Host             string             `yaml:"host"`
+	Port             uint16             `yaml:"port"`
+	User             string             `yaml:"user"`
+	Password         config_util.Secret `yaml:"password"`
+	PasswordFile     string             `yaml:"password_file,omitempty"`
+	ConnectionString config_util.Secret `yaml:"connection_string,omitempty"`
+	Schema           string             `yaml:"schema"`
+	MaxConnections   int                `yaml:"max_connections"`
+	ReadPoolSize     int                `yaml:"read_pool_size_max"`
+	WritePoolSize    int                `yaml:"write_pool_size_max"`
+	ConnectTimeout   int                `yaml:"connect_timeout"`
+	ReadTimeout      int                `yaml:"read_timeout"`
+	WriteTimeout     int                `yaml:"write_timeout"`
+	EnableTLS        bool               `yaml:"enable_tls"`
+	AllowInsecureTLS bool               `yaml:"allow_insecure_tls"`
+	TLSCAFile        string             `yaml:"tls_ca_file,omitempty"`
+	TLSCertFile      string             `yaml:"tls_cert_file,omitempty"`
+	TLSKeyFile       string             `yaml:"tls_key_file,omitempty"`
+	TLSServerName    string             `yaml:"tls_server_name,omitempty"`
+	Weight           int                `yaml:"weight"`
+}
+
+// UnmarshalYAML sets the default weight before unmarshaling, so that a weight
+// of 0 can be told apart from an omitted weight.
+func (ep *endpointConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain endpointConfig
+	*ep = endpointConfig{Weight: 1}
+	return unmarshal((*plain)(ep))
+}
+
+// Quote a value for use in a libpq-compatible DSN-style connection string.
+func quoteDSNValue(s string) string {
+	if s != "" && !strings.ContainsAny(s, " \t\n'\\") {
+		return s
+	}
+	return "'" + strings.NewReplacer("\\", "\\\\", "'", "\\'").Replace(s) + "'"
 }
 
 func (ep *endpointConfig) toDSN() string {
+	// A full connection string takes precedence over discrete connection parameters.
+	if ep.ConnectionString != "" {
+		return string(ep.ConnectionString)
+	}
+
 	// Convert endpointConfig data to libpq-compatible DSN-style connection string.
 	var params []string
 	if ep.Host != "" {
-		params = append(params, fmt.Sprintf("host=%s", ep.Host))
+		params = append(params, fmt.Sprintf("host=%s", quoteDSNValue(ep.Host)))
 	}
 	if ep.Port != 0 {
 		params = append(params, fmt.Sprintf("port=%v", ep.Port))
 	}
 	if ep.User != "" {
-		params = append(params, fmt.Sprintf("user=%s", ep.User))
+		params = append(params, fmt.Sprintf("user=%s", quoteDSNValue(ep.User)))
 	}
 	if ep.Password != "" {
-		params = append(params, fmt.Sprintf("password=%s", ep.Password))
+		params = append(params, fmt.Sprintf("password=%s", quoteDSNValue(string(ep.Password))))
 	}
 	if ep.Schema != "" {
-		params = append(params, fmt.Sprintf("database=%s", ep.Schema))
+		params = append(params, fmt.Sprintf("database=%s", quoteDSNValue(ep.Schema)))
 	}
 	if ep.ConnectTimeout != 0 {
 		params = append(params, fmt.Sprintf("connect_timeout=%v", ep.ConnectTimeout))
@@ -394,14 +525,226 @@ func (ep *endpointConfig) toDSN() string {
 	return strings.Join(params, " ")
 }
 
+// Describe the endpoint for logging purposes, without revealing any secrets.
+func (ep *endpointConfig) toString() string {
+	if ep.ConnectionString != "" {
+		return redactConnectionString(string(ep.ConnectionString))
+	}
+	return fmt.Sprintf("%s@%s:%d/%s", ep.User, ep.Host, ep.Port, ep.Schema)
+}
+
+var (
+	dsnPasswordPattern = regexp.MustCompile(`(password\s*=\s*)('(\\.|[^'])*'|\S+)`)
+	urlPasswordPattern = regexp.MustCompile(`(://[^:/@]*:)[^@]*@`)
+)
+
+// Remove passwords from URL and DSN-style connection strings.
+func redactConnectionString(s string) string {
+	if !strings.Contains(s, "://") {
+		return dsnPasswordPattern.ReplaceAllString(s, "${1}xxxxx")
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		// Also redact URLs which can not be parsed, but may be accepted by pgx.
+		s = urlPasswordPattern.ReplaceAllString(s, "${1}xxxxx@")
+		return dsnPasswordPattern.ReplaceAllString(s, "${1}xxxxx")
+	}
+	query := u.Query()
+	if query.Has("password") {
+		query.Set("password", "xxxxx")
+		u.RawQuery = query.Encode()
+	}
+	return u.Redacted()
+}
+
+// Read secrets from files, and check that the connection settings are consistent.
+func (ep *endpointConfig) resolveSecrets() error {
+	if ep.PasswordFile != "" {
+		if ep.Password != "" {
+			return fmt.Errorf("at most one of password and password_file must be configured")
+		}
+		content, err := ioutil.ReadFile(ep.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("reading password file %q failed: %v", ep.PasswordFile, err)
+		}
+		ep.Password = config_util.Secret(strings.TrimRight(string(content), "\r\n"))
+	}
+	if ep.ConnectionString != "" && (ep.Host != "" || ep.Port != 0 || ep.User != "" || ep.Password != "") {
+		return fmt.Errorf("connection_string can not be combined with host, port, user, password or password_file")
+	}
+	return nil
+}
+
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Expand `${VAR}` references to environment variables within a setting, using
+// `$$` for a literal `$`. The values are passed through `escape`, if given,
+// together with the part of the setting before the reference.
+func expandEnv(s string, escape func(prefix, value string) string) (string, error) {
+	var b strings.Builder
+	var missing []string
+	last := 0
+	for _, m := range envPattern.FindAllStringSubmatchIndex(s, -1) {
+		b.WriteString(s[last:m[0]])
+		last = m[1]
+		if m[2] < 0 {
+			b.WriteByte('$')
+			continue
+		}
+		name := s[m[2]:m[3]]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		if escape != nil {
+			value = escape(s[:m[0]], value)
+		}
+		b.WriteString(value)
+	}
+	b.WriteString(s[last:])
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+	return b.String(), nil
+}
+
+// Expand environment variables within all string settings of a configuration
+// file, leaving relabeling rules alone, as their replacements reference
+// capture groups using the same syntax.
+func expandConfigEnv(content []byte) ([]byte, error) {
+	var doc yaml.MapSlice
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, fmt.Errorf("error unmarshaling YAML: %v", err)
+	}
+	expanded, err := expandEnvValue(doc, "")
+	if err != nil {
+		return nil, fmt.Errorf("error expanding environment variables: %v", err)
+	}
+	return yaml.Marshal(expanded)
+}
+
+func expandEnvValue(v interface{}, key string) (interface{}, error) {
+	switch v := v.(type) {
+	case yaml.MapSlice:
+		for i := range v {
+			k, _ := v[i].Key.(string)
+			if strings.HasSuffix(k, "relabel_configs") {
+				continue
+			}
+			expanded, err := expandEnvValue(v[i].Value, k)
+			if err != nil {
+				return nil, err
+			}
+			v[i].Value = expanded
+		}
+	case []interface{}:
+		for i := range v {
+			expanded, err := expandEnvValue(v[i], key)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	case string:
+		var escape func(prefix, value string) string
+		if key == "connection_string" {
+			escape = escapeDSNValue
+			if strings.HasPrefix(v, "postgres://") || strings.HasPrefix(v, "postgresql://") {
+				escape = escapeURLComponent
+			}
+		}
+		expanded, err := expandEnv(v, escape)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", key, err)
+		}
+		if expanded != v {
+			return resolveScalar(expanded), nil
+		}
+	}
+	return v, nil
+}
+
+// Resolve expanded values to numbers or booleans, so that they can be used for
+// settings like `port`, if they are in the canonical form. Other values, like
+// `0x10` or `yes`, are kept as strings.
+func resolveScalar(s string) interface{} {
+	var value interface{}
+	if err := yaml.Unmarshal([]byte(s), &value); err != nil {
+		return s
+	}
+	switch value.(type) {
+	case int, int64, uint64, float64, bool:
+		if out, err := yaml.Marshal(value); err == nil && strings.TrimSuffix(string(out), "\n") == s {
+			return value
+		}
+	}
+	return s
+}
+
+// Percent-encode all characters but the unreserved ones of RFC 3986, so that
+// values can be used within any part of a URL.
+func escapeURLComponent(_, s string) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '.' || c == '_' || c == '~' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// Escape backslashes and quotes of values within connection strings in the
+// keyword/value format. Outside of quoted values, values containing whitespace
+// and empty values are quoted.
+func escapeDSNValue(prefix, s string) string {
+	escaped := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(s)
+	quoted := false
+	for i := 0; i < len(prefix); i++ {
+		switch prefix[i] {
+		case '\\':
+			i++
+		case '\'':
+			quoted = !quoted
+		}
+	}
+	if !quoted && (strings.ContainsAny(s, " \t\n\r\v\f") || s == "" && strings.HasSuffix(prefix, "=")) {
+		return "'" + escaped + "'"
+	}
+	return escaped
+}
+
+func (ep *endpointConfig) validateTLS() error {
+	if !ep.EnableTLS && (ep.TLSCAFile != "" || ep.TLSCertFile != "" || ep.TLSKeyFile != "" || ep.TLSServerName != "") {
+		return fmt.Errorf("TLS settings require enable_tls")
+	}
+	if (ep.TLSCertFile == "") != (ep.TLSKeyFile == "") {
+		return fmt.Errorf("tls_cert_file and tls_key_file must be configured together")
+	}
+	return nil
+}
+
 type config struct {
-	Endpoints []endpointConfig `yaml:"cratedb_endpoints"`
+	Endpoints           []endpointConfig    `yaml:"cratedb_endpoints"`
+	LoadBalancing       loadBalancingConfig `yaml:"load_balancing"`
+	Retry               retryConfig         `yaml:"retry"`
+	Cardinality         cardinalityConfig   `yaml:"cardinality"`
+	QueryStats          queryStatsConfig    `yaml:"query_stats"`
+	QueryCache          queryCacheConfig    `yaml:"query_cache"`
+	Tracing             tracingConfig       `yaml:"tracing"`
+	WriteRelabelConfigs []*relabel.Config   `yaml:"write_relabel_configs,omitempty"`
+	ScrapeConfigs       *scrapeConfigs      `yaml:"scrape_configs,omitempty"`
+	RuleFiles           []string            `yaml:"rule_files,omitempty"`
+	EvaluationInterval  model.Duration      `yaml:"evaluation_interval"`
+	Alerting            alertingConfig      `yaml:"alerting"`
+	Tenants             []string            `yaml:"tenants,omitempty"`
 }
 
 func (c *config) toString() string {
 	var ep []string
 	for _, e := range c.Endpoints {
-		ep = append(ep, fmt.Sprintf("%s@%s:%d/%s", e.User, e.Host, e.Port, e.Schema))
+		ep = append(ep, e.toString())
 	}
 	return strings.Join(ep, ",")
 }
@@ -421,14 +764,25 @@ func loadConfig(filename string) (*config, error) {
 		content, err := ioutil.ReadFile(filename)
 		if err != nil {
 			return nil, fmt.Errorf("reading configuration file %q failed: %v", filename, err)
-		} else {
-			if err = yaml.UnmarshalStrict(content, conf); err != nil {
-				return nil, fmt.Errorf("error unmarshaling YAML: %v", err)
-			}
+		}
+		if content, err = expandConfigEnv(content); err != nil {
+			return nil, err
+		}
+		if err = yaml.UnmarshalStrict(content, conf); err != nil {
+			return nil, fmt.Errorf("error unmarshaling YAML: %v", err)
+		}
+		if conf.ScrapeConfigs != nil {
+			conf.ScrapeConfigs.setDirectory(filename)
+		}
+		if conf.QueryCache.Directory != "" {
+			conf.QueryCache.Directory = config_util.JoinDir(filepath.Dir(filename), conf.QueryCache.Directory)
+		}
+		for i := range conf.RuleFiles {
+			conf.RuleFiles[i] = config_util.JoinDir(filepath.Dir(filename), conf.RuleFiles[i])
 		}
 	} else {
 		logger.Error("No configuration file used, falling back to built-in configuration")
-		item := endpointConfig{}
+		item := endpointConfig{Weight: 1}
 		conf.Endpoints = []endpointConfig{item}
 	}
 
@@ -436,17 +790,23 @@ func loadConfig(filename string) (*config, error) {
 		return nil, fmt.Errorf("no CrateDB endpoints provided in configuration file")
 	}
 	for i := range conf.Endpoints {
-		if conf.Endpoints[i].Host == "" {
-			conf.Endpoints[i].Host = "localhost"
-		}
-		if conf.Endpoints[i].Port == 0 {
-			conf.Endpoints[i].Port = 5432
+		if err := conf.Endpoints[i].resolveSecrets(); err != nil {
+			return nil, fmt.Errorf("invalid settings for endpoint #%d: %v", i+1, err)
 		}
-		if conf.Endpoints[i].User == "" {
-			conf.Endpoints[i].User = "crate"
-		}
-		if conf.Endpoints[i].ConnectTimeout == 0 {
-			conf.Endpoints[i].ConnectTimeout = 10
+		// When using a connection string, all connection parameters are taken from it.
+		if conf.Endpoints[i].ConnectionString == "" {
+			if conf.Endpoints[i].Host == "" {
+				conf.Endpoints[i].Host = "localhost"
+			}
+			if conf.Endpoints[i].Port == 0 {
+				conf.Endpoints[i].Port = 5432
+			}
+			if conf.Endpoints[i].User == "" {
+				conf.Endpoints[i].User = "crate"
+			}
+			if conf.Endpoints[i].ConnectTimeout == 0 {
+				conf.Endpoints[i].ConnectTimeout = 10
+			}
 		}
 		if conf.Endpoints[i].ReadTimeout == 0 {
 			conf.Endpoints[i].ReadTimeout = 5
@@ -454,10 +814,96 @@ func loadConfig(filename string) (*config, error) {
 		if conf.Endpoints[i].WriteTimeout == 0 {
 			conf.Endpoints[i].WriteTimeout = 5
 		}
+		if conf.Endpoints[i].Weight < 1 {
+			return nil, fmt.Errorf("invalid settings for endpoint %s: weight must be positive", conf.Endpoints[i].toString())
+		}
+		if err := conf.Endpoints[i].validateTLS(); err != nil {
+			return nil, fmt.Errorf("invalid TLS settings for endpoint %s: %v", conf.Endpoints[i].toString(), err)
+		}
+	}
+	if conf.LoadBalancing.Read == "" {
+		conf.LoadBalancing.Read = lbRoundRobin
+	}
+	if conf.LoadBalancing.Write == "" {
+		conf.LoadBalancing.Write = lbRoundRobin
+	}
+	if err := conf.LoadBalancing.validate(); err != nil {
+		return nil, err
+	}
+	conf.Retry.Read.setDefaults()
+	conf.Retry.Write.setDefaults()
+	if err := conf.Retry.validate(); err != nil {
+		return nil, err
+	}
+	if conf.Cardinality.Mode == "" {
+		conf.Cardinality.Mode = cardinalityModeExact
+	}
+	if conf.Cardinality.ActiveWindow == 0 {
+		conf.Cardinality.ActiveWindow = model.Duration(time.Hour)
+	}
+	if err := conf.Cardinality.validate(); err != nil {
+		return nil, err
+	}
+	if conf.QueryStats.MaxQueries == 0 {
+		conf.QueryStats.MaxQueries = 1000
+	}
+	if err := conf.QueryStats.validate(); err != nil {
+		return nil, err
+	}
+	if conf.QueryCache.MaxSamples == 0 {
+		conf.QueryCache.MaxSamples = 5000000
+	}
+	if conf.QueryCache.ImmutableAfter == 0 {
+		conf.QueryCache.ImmutableAfter = model.Duration(48 * time.Hour)
+	}
+	if conf.QueryCache.DirectoryMaxAge == 0 {
+		conf.QueryCache.DirectoryMaxAge = model.Duration(7 * 24 * time.Hour)
+	}
+	if err := conf.QueryCache.validate(); err != nil {
+		return nil, err
+	}
+	if conf.EvaluationInterval == 0 {
+		conf.EvaluationInterval = model.Duration(time.Minute)
+	}
+	conf.Alerting.setDefaults()
+	if err := conf.Alerting.validate(); err != nil {
+		return nil, err
+	}
+	if err := conf.Tracing.validate(); err != nil {
+		return nil, err
+	}
+	for _, rc := range conf.WriteRelabelConfigs {
+		if rc == nil {
+			return nil, fmt.Errorf("empty or null write relabeling rule")
+		}
+		if err := rc.Validate(model.UTF8Validation); err != nil {
+			return nil, fmt.Errorf("invalid write relabeling rule: %v", err)
+		}
 	}
 	return conf, nil
 }
 
+// Create the CrateDB endpoints, and a single endpoint which load-balances and
+// retries requests across them.
+func setupEndpoints(conf *config) ([]*crateEndpoint, endpoint.Endpoint, error) {
+	endpoints := []*crateEndpoint{}
+	readEndpoints := []*balancedEndpoint{}
+	writeEndpoints := []*balancedEndpoint{}
+	for _, epConf := range conf.Endpoints {
+		ep, err := newCrateEndpoint(&epConf)
+		if err != nil {
+			return nil, nil, err
+		}
+		endpoints = append(endpoints, ep)
+		// Keep track of read and write requests individually, because their latencies differ.
+		readEndpoints = append(readEndpoints, newBalancedEndpoint(ep.endpoint(), epConf.Weight))
+		writeEndpoints = append(writeEndpoints, newBalancedEndpoint(ep.endpoint(), epConf.Weight))
+	}
+	readRetry := newRetryPolicy(&conf.Retry.Read, "read", len(endpoints)).endpoint(newBalancer(conf.LoadBalancing.Read, readEndpoints))
+	writeRetry := newRetryPolicy(&conf.Retry.Write, "write", len(endpoints)).endpoint(newBalancer(conf.LoadBalancing.Write, writeEndpoints))
+	return endpoints, dispatchByRequestType(readRetry, writeRetry), nil
+}
+
 func builtinConfig() *config {
 	blueprint, _ := loadConfig("")
 	return blueprint
@@ -467,6 +913,30 @@ func main() {
 
 	logger.Info("Starting CrateDB Prometheus Adapter", "version", version)
 
+	// Subcommands parse their own flags.
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "backfill":
+			if err := runBackfill(os.Args[2:]); err != nil {
+				logger.Error("Backfill failed", "err", err)
+				os.Exit(1)
+			}
+			return
+		case "export":
+			if err := runExport(os.Args[2:]); err != nil {
+				logger.Error("Export failed", "err", err)
+				os.Exit(1)
+			}
+			return
+		case "import":
+			if err := runImport(os.Args[2:]); err != nil {
+				logger.Error("Import failed", "err", err)
+				os.Exit(1)
+			}
+			return
+		}
+	}
+
 	flag.Parse()
 
 	if *printVersion {
@@ -479,21 +949,66 @@ func main() {
 		return
 	}
 
+	// Set up metrics after parsing the flags, so that the prefix is honored.
+	setupMetrics(*metricsExportPrefix, *metricsLegacyNames)
+
 	conf, err := loadConfig(*configFile)
 	if err != nil {
 		logger.Error("Error loading configuration", "config", *configFile, "err", err)
+		os.Exit(1)
 	}
+	metrics.setTenants(conf.Tenants)
 
-	subscriber := sd.FixedEndpointer{}
-	for _, epConf := range conf.Endpoints {
-		subscriber = append(subscriber, newCrateEndpoint(&epConf).endpoint())
+	shutdownTracing, err := setupTracing(&conf.Tracing)
+	if err != nil {
+		logger.Error("Error setting up tracing", "err", err)
+		os.Exit(1)
+	}
+
+	endpoints, ep, err := setupEndpoints(conf)
+	if err != nil {
+		logger.Error("Error loading configuration", "config", *configFile, "err", err)
+		os.Exit(1)
 	}
-	balancer := lb.NewRoundRobin(subscriber)
-	// Try each endpoint once.
-	retry := lb.Retry(len(conf.Endpoints), 1*time.Minute, balancer)
+	metrics.registry.MustRegister(newPoolCollector(endpoints))
 
 	ca := crateDbPrometheusAdapter{
-		ep: retry,
+		ep:                  ep,
+		writeRelabelConfigs: conf.WriteRelabelConfigs,
+	}
+	ca.queryStats = newQueryStats(&conf.QueryStats)
+	http.HandleFunc("/api/v1/status/queries", ca.queryStats.handleStatus)
+	if conf.QueryCache.Enabled {
+		ca.queryCache, err = newQueryCache(&conf.QueryCache, conf.Endpoints)
+		if err != nil {
+			logger.Error("Error setting up query cache", "err", err)
+			os.Exit(1)
+		}
+	}
+	if conf.Cardinality.Enabled {
+		ca.cardinality = newCardinalityTracker(&conf.Cardinality)
+		metrics.registry.MustRegister(ca.cardinality)
+		http.HandleFunc("/api/v1/status/cardinality", ca.cardinality.handleStatus)
+	}
+	// Scrape targets directly, when configured, like a minimal Prometheus agent.
+	var scrapes *scraper
+	if conf.ScrapeConfigs != nil {
+		scrapes, err = newScraper(conf.ScrapeConfigs, &ca, &scrape.Options{DiscoveryReloadOnStartup: true}, metrics.registry)
+		if err != nil {
+			logger.Error("Error setting up scraping", "err", err)
+			os.Exit(1)
+		}
+		scrapes.run()
+	}
+	// Evaluate recording and alerting rules against the data stored in CrateDB, when configured.
+	var ruleEval *ruleEvaluator
+	if len(conf.RuleFiles) > 0 {
+		ruleEval, err = newRuleEvaluator(conf, &ca, metrics.registry)
+		if err != nil {
+			logger.Error("Error setting up rule evaluation", "err", err)
+			os.Exit(1)
+		}
+		ruleEval.run()
 	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
@@ -504,11 +1019,77 @@ func main() {
     </html>`))
 	})
 
-	http.HandleFunc("/write", ca.handleWrite)
-	http.HandleFunc("/read", ca.handleRead)
-	http.Handle("/metrics", promhttp.Handler())
+	ready := newReadiness(endpoints)
+	http.HandleFunc("/-/healthy", handleHealthy)
+	http.HandleFunc("/-/ready", ready.handleReady)
+
+	http.HandleFunc("/write", metrics.instrumentHandler("write", traceHandler("write", ca.handleWrite)))
+	http.HandleFunc("/read", metrics.instrumentHandler("read", traceHandler("read", ca.handleRead)))
+	http.HandleFunc("/api/v1/import/prometheus", metrics.instrumentHandler("import", traceHandler("import", ca.handleImport)))
+	// The InfluxDB v1 API is served below `/influx`, as `/write` is used for remote write.
+	http.HandleFunc("/api/v2/write", metrics.instrumentHandler("influx_write", traceHandler("influx_write", ca.handleInfluxWrite)))
+	http.HandleFunc("/influx/write", metrics.instrumentHandler("influx_write", traceHandler("influx_write", ca.handleInfluxWrite)))
+	http.HandleFunc(pushPathPrefix+"/", metrics.instrumentHandler("push", traceHandler("push", ca.handlePush)))
+	http.HandleFunc(pushPathPrefix+"@base64/", metrics.instrumentHandler("push", traceHandler("push", ca.handlePush)))
+	http.Handle("/metrics", promhttp.HandlerFor(metrics.registry, promhttp.HandlerOpts{}))
 	logger.Info("Listening ...", "address", *listenAddress)
 	logger.Info("Connecting ...", "endpoints", conf.toString())
-	listen_error := http.ListenAndServe(*listenAddress, nil)
-	logger.Info("Final outcome", "err", listen_error)
+	server := &http.Server{Addr: *listenAddress}
+	// Enable TLS and authentication according to the web configuration file.
+	var webAuth *webHandler
+	if *webConfigFile != "" {
+		webAuth, err = newWebHandler(*webConfigFile, http.DefaultServeMux)
+		if err != nil {
+			logger.Error("Error loading web configuration", "err", err)
+			os.Exit(1)
+		}
+	}
+
+	// Reconnect to all endpoints, and reload the rule files and the web
+	// configuration on SIGHUP.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			logger.Info("Reconnecting to CrateDB endpoints")
+			for _, ep := range endpoints {
+				ep.reconnect()
+			}
+			if ruleEval != nil {
+				if err := ruleEval.reload(); err != nil {
+					logger.Error("Error reloading rule files", "err", err)
+				}
+			}
+			if webAuth != nil {
+				if err := webAuth.reload(); err != nil {
+					logger.Error("Error reloading web configuration", "err", err)
+				}
+			}
+		}
+	}()
+
+	// Serve until the listener fails, or until a termination signal is received.
+	signals, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- listenAndServeWeb(server, webAuth)
+	}()
+	select {
+	case listen_error := <-serveErr:
+		logger.Info("Final outcome", "err", listen_error)
+	case <-signals.Done():
+		stop()
+		if scrapes != nil {
+			scrapes.stop()
+		}
+		if ruleEval != nil {
+			ruleEval.stop()
+		}
+		shutdownGracefully(server, ready, *shutdownDelay, *shutdownTimeout, endpoints)
+		logger.Info("Final outcome", "err", <-serveErr)
+	}
+	if err := shutdownTracing(context.Background()); err != nil {
+		logger.Error("Error flushing traces", "err", err)
+	}
 }
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// Shut down the HTTP server gracefully. Readiness is flipped first, and after
+// waiting for `delay`, so that load balancers can stop sending new requests,
+// in-flight requests are drained for at most `timeout`. Finally, the connection
+// pools of all endpoints are closed.
+func shutdownGracefully(server *http.Server, ready *readiness, delay time.Duration, timeout time.Duration, endpoints []*crateEndpoint) error {
+	logger.Info("Shutting down ...", "delay", delay, "timeout", timeout)
+	ready.shuttingDown.Store(true)
+	time.Sleep(delay)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		logger.Warn("Failed to drain in-flight requests", "err", err)
+		server.Close()
+	}
+
+	for _, ep := range endpoints {
+		ep.close()
+	}
+	logger.Info("Shutdown complete")
+	return err
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Serve a handler which blocks until `release` is closed, and signals on
+// `started` once a request has arrived.
+func startBlockingServer(t *testing.T, started chan<- struct{}, release <-chan struct{}) (*http.Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.Write([]byte("done"))
+	})}
+	go serveWeb(l, server, nil)
+	return server, "http://" + l.Addr().String()
+}
+
+func TestShutdownGracefully(t *testing.T) {
+	endpoint, err := newCrateEndpoint(&builtinConfig().Endpoints[0])
+	require.NoError(t, err)
+	readPool, writePool, err := endpoint.pools(context.Background())
+	require.NoError(t, err)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server, url := startBlockingServer(t, started, release)
+
+	body := make(chan string)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		content, _ := io.ReadAll(resp.Body)
+		body <- string(content)
+	}()
+	<-started
+
+	ready := newReadiness(nil)
+	done := make(chan error)
+	go func() {
+		done <- shutdownGracefully(server, ready, 0, 5*time.Second, []*crateEndpoint{endpoint})
+	}()
+
+	// The in-flight request is drained before shutdown completes.
+	require.Eventually(t, ready.shuttingDown.Load, time.Second, 10*time.Millisecond)
+	close(release)
+	require.Equal(t, "done", <-body)
+	require.NoError(t, <-done)
+
+	_, err = readPool.Acquire(context.Background())
+	require.ErrorContains(t, err, "closed pool")
+	_, err = writePool.Acquire(context.Background())
+	require.ErrorContains(t, err, "closed pool")
+	require.ErrorContains(t, endpoint.createPools(context.Background()), "is closed")
+}
+
+func TestShutdownGracefullyTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+	server, url := startBlockingServer(t, started, release)
+
+	go http.Get(url)
+	<-started
+
+	err := shutdownGracefully(server, newReadiness(nil), 0, 50*time.Millisecond, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	config_util "github.com/prometheus/common/config"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	tracerName         = "github.com/crate/cratedb-prometheus-adapter"
+	tracingServiceName = "cratedb-prometheus-adapter"
+
+	tracingExporterNone   = "none"
+	tracingExporterOTLP   = "otlp"
+	tracingExporterFile   = "file"
+	tracingExporterStdout = "stdout"
+
+	tracingProtocolGRPC = "grpc"
+	tracingProtocolHTTP = "http"
+)
+
+type tracingConfig struct {
+	Exporter         string                        `yaml:"exporter"`
+	Endpoint         string                        `yaml:"endpoint,omitempty"`
+	Protocol         string                        `yaml:"protocol,omitempty"`
+	Insecure         bool                          `yaml:"insecure,omitempty"`
+	Headers          map[string]config_util.Secret `yaml:"headers,omitempty"`
+	File             string                        `yaml:"file,omitempty"`
+	SamplingFraction float64                       `yaml:"sampling_fraction"`
+}
+
+// UnmarshalYAML samples all new traces by default, so that configuring an
+// exporter records spans without also setting the sampling fraction.
+func (c *tracingConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain tracingConfig
+	*c = tracingConfig{SamplingFraction: 1}
+	return unmarshal((*plain)(c))
+}
+
+func (c *tracingConfig) validate() error {
+	switch c.Exporter {
+	case "", tracingExporterNone, tracingExporterStdout:
+	case tracingExporterOTLP:
+		if c.Endpoint == "" {
+			return fmt.Errorf("tracing exporter %q requires an endpoint", c.Exporter)
+		}
+		switch c.Protocol {
+		case "", tracingProtocolGRPC, tracingProtocolHTTP:
+		default:
+			return fmt.Errorf("unknown tracing protocol %q", c.Protocol)
+		}
+	case tracingExporterFile:
+		if c.File == "" {
+			return fmt.Errorf("tracing exporter %q requires a file", c.Exporter)
+		}
+	default:
+		return fmt.Errorf("unknown tracing exporter %q", c.Exporter)
+	}
+	if c.SamplingFraction < 0 || c.SamplingFraction > 1 {
+		return fmt.Errorf("tracing sampling_fraction must be between 0 and 1")
+	}
+	return nil
+}
+
+// Trace context propagation, compatible with the tracing support of Prometheus.
+var tracePropagator = propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{})
+
+// Set up the global OpenTelemetry tracer provider. Returns a function which
+// flushes pending spans and releases the exporter.
+func setupTracing(conf *tracingConfig) (func(context.Context) error, error) {
+	var closer io.Closer
+	var exporter sdktrace.SpanExporter
+	var err error
+	switch conf.Exporter {
+	case "", tracingExporterNone:
+		return func(context.Context) error { return nil }, nil
+	case tracingExporterOTLP:
+		exporter, err = newOTLPExporter(conf)
+	case tracingExporterFile:
+		var f *os.File
+		f, err = os.OpenFile(conf.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+		if err != nil {
+			return nil, fmt.Errorf("error opening tracing file: %v", err)
+		}
+		closer = f
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(f))
+	case tracingExporterStdout:
+		exporter, err = stdouttrace.New(stdouttrace.WithWriter(os.Stdout), stdouttrace.WithPrettyPrint())
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracing exporter: %v", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", tracingServiceName),
+			attribute.String("service.version", version),
+		)),
+		// Always continue traces sampled by the caller, like Prometheus.
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(conf.SamplingFraction))),
+	)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(tracePropagator)
+
+	return func(ctx context.Context) error {
+		err := provider.Shutdown(ctx)
+		if closer != nil {
+			if cerr := closer.Close(); err == nil {
+				err = cerr
+			}
+		}
+		return err
+	}, nil
+}
+
+func newOTLPExporter(conf *tracingConfig) (sdktrace.SpanExporter, error) {
+	headers := map[string]string{}
+	for k, v := range conf.Headers {
+		headers[k] = string(v)
+	}
+	if conf.Protocol == tracingProtocolHTTP {
+		opts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(conf.Endpoint),
+			otlptracehttp.WithHeaders(headers),
+		}
+		if conf.Insecure {
+			opts = append(opts, otlptracehttp.WithInsecure())
+		}
+		return otlptracehttp.New(context.Background(), opts...)
+	}
+	opts := []otlptracegrpc.Option{
+		otlptracegrpc.WithEndpoint(conf.Endpoint),
+		otlptracegrpc.WithHeaders(headers),
+	}
+	if conf.Insecure {
+		opts = append(opts, otlptracegrpc.WithInsecure())
+	}
+	return otlptracegrpc.New(context.Background(), opts...)
+}
+
+// Start a new span using the global tracer provider.
+func startSpan(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, opts...)
+}
+
+// End a span, recording the error if there was one.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// Wrap an HTTP handler into a server span, continuing the trace of the caller.
+func traceHandler(handler string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := tracePropagator.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := startSpan(ctx, handler,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				attribute.String("http.request.method", r.Method),
+				attribute.String("url.path", r.URL.Path),
+			))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w, code: http.StatusOK}
+		h(rec, r.WithContext(ctx))
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.code))
+		if rec.code >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.code))
+		}
+	}
+}
+
+// pgxTracer creates spans for connecting to CrateDB, acquiring connections
+// from the pools, and running queries and batches.
+type pgxTracer struct{}
+
+var (
+	_ pgx.QueryTracer       = pgxTracer{}
+	_ pgx.BatchTracer       = pgxTracer{}
+	_ pgx.ConnectTracer     = pgxTracer{}
+	_ pgxpool.AcquireTracer = pgxTracer{}
+)
+
+// Resolve the names of prepared statements to their SQL text.
+func statementText(sql string) string {
+	if sql == crateWriteStatementName {
+		return crateWriteStatement
+	}
+	return sql
+}
+
+func (pgxTracer) TraceQueryStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryStartData) context.Context {
+	ctx, _ = startSpan(ctx, "pgx query",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("db.query.text", statementText(data.SQL))))
+	return ctx
+}
+
+func (pgxTracer) TraceQueryEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceQueryEndData) {
+	span := trace.SpanFromContext(ctx)
+	if data.Err == nil {
+		span.SetAttributes(attribute.Int64("db.response.returned_rows", data.CommandTag.RowsAffected()))
+	}
+	endSpan(span, data.Err)
+}
+
+func (pgxTracer) TraceBatchStart(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchStartData) context.Context {
+	attrs := []attribute.KeyValue{attribute.Int("db.operation.batch.size", data.Batch.Len())}
+	if data.Batch.Len() > 0 {
+		attrs = append(attrs, attribute.String("db.query.text", statementText(data.Batch.QueuedQueries[0].SQL)))
+	}
+	ctx, _ = startSpan(ctx, "pgx batch", trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+	return ctx
+}
+
+// TraceBatchQuery does not create spans, because batches contain one query per sample.
+func (pgxTracer) TraceBatchQuery(context.Context, *pgx.Conn, pgx.TraceBatchQueryData) {}
+
+func (pgxTracer) TraceBatchEnd(ctx context.Context, _ *pgx.Conn, data pgx.TraceBatchEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+func (pgxTracer) TraceConnectStart(ctx context.Context, data pgx.TraceConnectStartData) context.Context {
+	ctx, _ = startSpan(ctx, "pgx connect",
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("server.address", data.ConnConfig.Host),
+			attribute.Int("server.port", int(data.ConnConfig.Port)),
+		))
+	return ctx
+}
+
+func (pgxTracer) TraceConnectEnd(ctx context.Context, data pgx.TraceConnectEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
+
+func (pgxTracer) TraceAcquireStart(ctx context.Context, _ *pgxpool.Pool, _ pgxpool.TraceAcquireStartData) context.Context {
+	ctx, _ = startSpan(ctx, "pgx acquire")
+	return ctx
+}
+
+func (pgxTracer) TraceAcquireEnd(ctx context.Context, _ *pgxpool.Pool, data pgxpool.TraceAcquireEndData) {
+	endSpan(trace.SpanFromContext(ctx), data.Err)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/golang/snappy"
+	"github.com/jackc/pgx/v5"
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Record all spans using a fresh global tracer provider.
+func recordSpans(t *testing.T) *tracetest.SpanRecorder {
+	recorder := tracetest.NewSpanRecorder()
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder)))
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+	return recorder
+}
+
+func spanNames(spans []sdktrace.ReadOnlySpan) []string {
+	names := []string{}
+	for _, span := range spans {
+		names = append(names, span.Name())
+	}
+	return names
+}
+
+func TestTracingConfigValidate(t *testing.T) {
+	valid := []tracingConfig{
+		{},
+		{Exporter: "none"},
+		{Exporter: "stdout", SamplingFraction: 1},
+		{Exporter: "otlp", Endpoint: "localhost:4317"},
+		{Exporter: "otlp", Endpoint: "localhost:4318", Protocol: "http"},
+		{Exporter: "file", File: "traces.json"},
+	}
+	for _, conf := range valid {
+		require.NoError(t, conf.validate(), "%+v", conf)
+	}
+
+	invalid := []tracingConfig{
+		{Exporter: "jaeger"},
+		{Exporter: "otlp"},
+		{Exporter: "otlp", Endpoint: "localhost:4317", Protocol: "thrift"},
+		{Exporter: "file"},
+		{Exporter: "stdout", SamplingFraction: 1.5},
+	}
+	for _, conf := range invalid {
+		require.Error(t, conf.validate(), "%+v", conf)
+	}
+}
+
+func TestTracingConfigSamplingFraction(t *testing.T) {
+	// All new traces are sampled by default, unless configured otherwise.
+	conf := tracingConfig{}
+	require.NoError(t, yaml.UnmarshalStrict([]byte(`exporter: "stdout"`), &conf))
+	require.Equal(t, 1.0, conf.SamplingFraction)
+	conf = tracingConfig{}
+	require.NoError(t, yaml.UnmarshalStrict([]byte("exporter: \"stdout\"\nsampling_fraction: 0"), &conf))
+	require.Equal(t, 0.0, conf.SamplingFraction)
+}
+
+func TestTraceHandlerRead(t *testing.T) {
+	recorder := recordSpans(t)
+
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return &crateReadResponse{}, nil
+		},
+	}
+	readRequest := prompb.ReadRequest{Queries: []*prompb.Query{{StartTimestampMs: 1, EndTimestampMs: 2}}}
+	data, err := readRequest.Marshal()
+	require.NoError(t, err)
+
+	req := httptest.NewRequest("POST", "/read", bytes.NewReader(snappy.Encode(nil, data)))
+	req.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	rec := httptest.NewRecorder()
+	traceHandler("read", ca.handleRead)(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	spans := recorder.Ended()
+	require.ElementsMatch(t, []string{"decode request", "queryToSQL", "runQuery", "encode response", "read"}, spanNames(spans))
+	for _, span := range spans {
+		require.Equal(t, "0af7651916cd43dd8448eb211c80319c", span.SpanContext().TraceID().String())
+	}
+	root := spans[len(spans)-1]
+	require.Equal(t, "read", root.Name())
+	require.Equal(t, "b7ad6b7169203331", root.Parent().SpanID().String())
+	require.True(t, root.Parent().IsRemote())
+}
+
+func TestTraceHandlerWriteFailure(t *testing.T) {
+	recorder := recordSpans(t)
+
+	ca := &crateDbPrometheusAdapter{
+		ep: func(ctx context.Context, request interface{}) (interface{}, error) {
+			return nil, context.DeadlineExceeded
+		},
+	}
+	data, err := (&prompb.WriteRequest{}).Marshal()
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	traceHandler("write", ca.handleWrite)(rec, httptest.NewRequest("POST", "/write", bytes.NewReader(snappy.Encode(nil, data))))
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+
+	spans := recorder.Ended()
+	require.Equal(t, []string{"decode request", "convert timeseries", "write"}, spanNames(spans))
+	root := spans[len(spans)-1]
+	require.Contains(t, root.Attributes(), attribute.Int("http.response.status_code", http.StatusInternalServerError))
+	require.Equal(t, "Error", root.Status().Code.String())
+}
+
+func TestPgxTracerBatch(t *testing.T) {
+	recorder := recordSpans(t)
+
+	batch := &pgx.Batch{}
+	batch.Queue(crateWriteStatementName)
+	batch.Queue(crateWriteStatementName)
+
+	tracer := pgxTracer{}
+	ctx := tracer.TraceBatchStart(context.Background(), nil, pgx.TraceBatchStartData{Batch: batch})
+	tracer.TraceBatchEnd(ctx, nil, pgx.TraceBatchEndData{})
+
+	spans := recorder.Ended()
+	require.Len(t, spans, 1)
+	require.Equal(t, "pgx batch", spans[0].Name())
+	require.Contains(t, spans[0].Attributes(), attribute.String("db.query.text", crateWriteStatement))
+	require.Contains(t, spans[0].Attributes(), attribute.Int("db.operation.batch.size", 2))
+}
+
+func TestSetupTracingFile(t *testing.T) {
+	previous := otel.GetTracerProvider()
+	t.Cleanup(func() { otel.SetTracerProvider(previous) })
+
+	filename := filepath.Join(t.TempDir(), "traces.json")
+	shutdown, err := setupTracing(&tracingConfig{Exporter: "file", File: filename, SamplingFraction: 1})
+	require.NoError(t, err)
+
+	_, span := startSpan(context.Background(), "runQuery")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+
+	content, err := os.ReadFile(filename)
+	require.NoError(t, err)
+	require.Contains(t, string(content), `"Name":"runQuery"`)
+	require.Contains(t, string(content), tracingServiceName)
+}
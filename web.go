@@ -0,0 +1,230 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	config_util "github.com/prometheus/common/config"
+	"github.com/prometheus/exporter-toolkit/web"
+	"golang.org/x/crypto/bcrypt"
+	yaml "gopkg.in/yaml.v2"
+)
+
+// webConfig is a superset of the exporter-toolkit web configuration file format,
+// see https://prometheus.io/docs/prometheus/latest/configuration/https/.
+// In addition to TLS settings and bcrypt-hashed basic auth users, it also
+// accepts a list of bearer tokens.
+type webConfig struct {
+	TLSConfig    web.TLSConfig                 `yaml:"tls_server_config"`
+	HTTPConfig   web.HTTPConfig                `yaml:"http_server_config"`
+	Users        map[string]config_util.Secret `yaml:"basic_auth_users"`
+	BearerTokens []config_util.Secret          `yaml:"bearer_tokens"`
+}
+
+func loadWebConfig(filename string) (*webConfig, error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, fmt.Errorf("reading web configuration file %q failed: %v", filename, err)
+	}
+	c := &webConfig{
+		TLSConfig: web.TLSConfig{
+			MinVersion:               tls.VersionTLS12,
+			MaxVersion:               tls.VersionTLS13,
+			PreferServerCipherSuites: true,
+		},
+		HTTPConfig: web.HTTPConfig{HTTP2: true},
+	}
+	if err := yaml.UnmarshalStrict(content, c); err != nil {
+		return nil, fmt.Errorf("error unmarshaling web configuration YAML: %v", err)
+	}
+	c.TLSConfig.SetDirectory(filepath.Dir(filename))
+	for user, hash := range c.Users {
+		if _, err := bcrypt.Cost([]byte(hash)); err != nil {
+			return nil, fmt.Errorf("invalid bcrypt hash for basic auth user %q: %v", user, err)
+		}
+	}
+	for i, token := range c.BearerTokens {
+		if token == "" {
+			return nil, fmt.Errorf("bearer token #%d is empty", i+1)
+		}
+	}
+	return c, nil
+}
+
+// How many bcrypt comparisons are cached at most.
+const webAuthCacheSize = 1000
+
+// webHandler enforces basic and bearer authentication. The web configuration
+// file is parsed once, and parsed again by `reload` on SIGHUP.
+type webHandler struct {
+	configFile string
+	handler    http.Handler
+	config     atomic.Pointer[webConfig]
+
+	// The results of bcrypt comparisons are cached, as they are CPU intensive.
+	// The comparisons themselves run without holding the lock.
+	mtx   sync.Mutex
+	cache map[string]bool
+}
+
+func newWebHandler(configFile string, handler http.Handler) (*webHandler, error) {
+	h := &webHandler{
+		configFile: configFile,
+		handler:    handler,
+	}
+	if err := h.reload(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// reload parses the web configuration file again. On errors, the previous
+// configuration is kept. Enabling or disabling TLS requires a restart, as the
+// listener is set up accordingly.
+func (h *webHandler) reload() error {
+	c, err := loadWebConfig(h.configFile)
+	if err != nil {
+		return err
+	}
+	if old := h.config.Load(); old != nil && old.TLSConfig.IsEnabled() != c.TLSConfig.IsEnabled() {
+		return fmt.Errorf("enabling or disabling TLS in web configuration file %q requires a restart", h.configFile)
+	}
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.config.Store(c)
+	h.cache = map[string]bool{}
+	return nil
+}
+
+func (h *webHandler) currentConfig() *webConfig {
+	return h.config.Load()
+}
+
+func (h *webHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c := h.currentConfig()
+	for k, v := range c.HTTPConfig.Header {
+		w.Header().Set(k, v)
+	}
+
+	if len(c.Users) == 0 && len(c.BearerTokens) == 0 {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if h.authorized(c, r) {
+		h.handler.ServeHTTP(w, r)
+		return
+	}
+
+	if len(c.Users) > 0 {
+		w.Header().Set("WWW-Authenticate", "Basic")
+	} else {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+	}
+	http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+}
+
+func (h *webHandler) authorized(c *webConfig, r *http.Request) bool {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		valid := false
+		for _, t := range c.BearerTokens {
+			if subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1 {
+				valid = true
+			}
+		}
+		return valid
+	}
+
+	user, pass, ok := r.BasicAuth()
+	if !ok {
+		return false
+	}
+	hash, validUser := c.Users[user]
+	if !validUser {
+		// Use a fixed password hash to prevent user enumeration by timing requests.
+		// This is a bcrypt-hashed version of "fakepassword".
+		hash = "$2y$10$QOauhQNbBCuQDKes6eFzPeMqBSjb7Mr5DUmpZ/VcEd00UAV/LDeSi"
+	}
+	sum := sha256.Sum256([]byte(user + "\x00" + string(hash) + "\x00" + pass))
+	key := hex.EncodeToString(sum[:])
+
+	h.mtx.Lock()
+	valid, cached := h.cache[key]
+	h.mtx.Unlock()
+	if cached {
+		return valid && validUser
+	}
+
+	valid = bcrypt.CompareHashAndPassword([]byte(hash), []byte(pass)) == nil
+
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	if len(h.cache) >= webAuthCacheSize {
+		// Evict an arbitrary entry.
+		for k := range h.cache {
+			delete(h.cache, k)
+			break
+		}
+	}
+	h.cache[key] = valid
+	return valid && validUser
+}
+
+// serveWeb serves HTTP requests on the listener. When a web handler is given,
+// TLS and authentication get enabled according to its configuration. TLS
+// certificates are loaded again on every new connection.
+func serveWeb(l net.Listener, server *http.Server, h *webHandler) error {
+	if h == nil {
+		logger.Info("TLS is disabled.", "address", l.Addr().String())
+		return server.Serve(l)
+	}
+	server.Handler = h
+
+	c := h.currentConfig()
+	if !c.TLSConfig.IsEnabled() {
+		logger.Info("TLS is disabled.", "address", l.Addr().String())
+		return server.Serve(l)
+	}
+
+	tlsConfig, err := web.ConfigToTLSConfig(&c.TLSConfig)
+	if err != nil {
+		return err
+	}
+	nextProtos := []string{"h2", "http/1.1"}
+	if !c.HTTPConfig.HTTP2 {
+		server.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
+		nextProtos = []string{"http/1.1"}
+	}
+	tlsConfig.GetConfigForClient = func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		config, err := web.ConfigToTLSConfig(&h.currentConfig().TLSConfig)
+		if err != nil {
+			return nil, err
+		}
+		config.NextProtos = nextProtos
+		return config, nil
+	}
+	server.TLSConfig = tlsConfig
+	logger.Info("TLS is enabled.", "http2", c.HTTPConfig.HTTP2, "address", l.Addr().String())
+	return server.ServeTLS(l, "", "")
+}
+
+// listenAndServeWeb listens on the server address and serves HTTP requests,
+// see `serveWeb`.
+func listenAndServeWeb(server *http.Server, h *webHandler) error {
+	l, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return err
+	}
+	defer l.Close()
+	return serveWeb(l, server, h)
+}
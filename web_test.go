@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeWebConfig(t *testing.T, filename string, content string) {
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+}
+
+func TestWebHandlerAuthentication(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "web.yml")
+	writeWebConfig(t, filename, fmt.Sprintf("basic_auth_users:\n  alice: %q\nbearer_tokens:\n- token1\n", hash))
+
+	handler, err := newWebHandler(filename, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	require.NoError(t, err)
+
+	cases := []struct {
+		user, pass, token string
+		status            int
+	}{
+		{status: http.StatusUnauthorized},
+		{user: "alice", pass: "secret", status: http.StatusOK},
+		// Second request is served from the cache.
+		{user: "alice", pass: "secret", status: http.StatusOK},
+		{user: "alice", pass: "wrong", status: http.StatusUnauthorized},
+		{user: "bob", pass: "fakepassword", status: http.StatusUnauthorized},
+		{token: "token1", status: http.StatusOK},
+		{token: "token2", status: http.StatusUnauthorized},
+	}
+	for _, c := range cases {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		if c.user != "" {
+			req.SetBasicAuth(c.user, c.pass)
+		}
+		if c.token != "" {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, c.status, rec.Code, "%+v", c)
+	}
+
+	// Changes to the configuration file are applied when reloading it.
+	writeWebConfig(t, filename, "bearer_tokens:\n- token2\n")
+	serve := func(token string) int {
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	require.Equal(t, http.StatusUnauthorized, serve("token2"))
+	require.NoError(t, handler.reload())
+	require.Equal(t, http.StatusOK, serve("token2"))
+
+	// Invalid configurations are rejected, keeping the previous one.
+	writeWebConfig(t, filename, "bearer_tokens:\n- \"\"\n")
+	require.Error(t, handler.reload())
+	require.Equal(t, http.StatusOK, serve("token2"))
+}
+
+func TestWebHandlerCacheSize(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("secret"), bcrypt.MinCost)
+	require.NoError(t, err)
+	filename := filepath.Join(t.TempDir(), "web.yml")
+	writeWebConfig(t, filename, fmt.Sprintf("basic_auth_users:\n  alice: %q\n", hash))
+	handler, err := newWebHandler(filename, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	require.NoError(t, err)
+
+	// The cache does not grow beyond its size.
+	for i := 0; i < webAuthCacheSize; i++ {
+		handler.cache[fmt.Sprint(i)] = true
+	}
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.SetBasicAuth("alice", "secret")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Len(t, handler.cache, webAuthCacheSize)
+
+	// Failed comparisons are cached as well.
+	handler.cache = map[string]bool{}
+	req.SetBasicAuth("alice", "wrong")
+	for i := 0; i < 2; i++ {
+		rec = httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusUnauthorized, rec.Code)
+	}
+	require.Len(t, handler.cache, 1)
+	for _, valid := range handler.cache {
+		require.False(t, valid)
+	}
+}
+
+func TestWebHandlerReloadTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "server")
+	filename := filepath.Join(dir, "web.yml")
+	tlsConfig := "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n"
+	plainConfig := "bearer_tokens:\n- token1\n"
+
+	// Enabling or disabling TLS on reload is rejected, keeping the previous configuration.
+	for _, tc := range [][2]string{{tlsConfig, plainConfig}, {plainConfig, tlsConfig}} {
+		writeWebConfig(t, filename, tc[0])
+		handler, err := newWebHandler(filename, http.NotFoundHandler())
+		require.NoError(t, err)
+		enabled := handler.currentConfig().TLSConfig.IsEnabled()
+
+		writeWebConfig(t, filename, tc[1])
+		require.ErrorContains(t, handler.reload(), "requires a restart")
+		require.Equal(t, enabled, handler.currentConfig().TLSConfig.IsEnabled())
+
+		writeWebConfig(t, filename, tc[0]+"http_server_config:\n  headers:\n    X-Test: reloaded\n")
+		require.NoError(t, handler.reload())
+		require.Equal(t, "reloaded", handler.currentConfig().HTTPConfig.Header["X-Test"])
+	}
+}
+
+func TestLoadWebConfig(t *testing.T) {
+	dir := t.TempDir()
+	cases := []struct {
+		content     string
+		errContains string
+	}{
+		{content: "basic_auth_users:\n  alice: plain\n", errContains: "invalid bcrypt hash"},
+		{content: "bearer_tokens:\n- \"\"\n", errContains: "bearer token #1 is empty"},
+		{content: "unknown: true\n", errContains: "field unknown not found"},
+	}
+	for _, c := range cases {
+		filename := filepath.Join(dir, "web.yml")
+		writeWebConfig(t, filename, c.content)
+		_, err := loadWebConfig(filename)
+		require.ErrorContains(t, err, c.errContains)
+	}
+
+	writeWebConfig(t, filepath.Join(dir, "web.yml"), "tls_server_config:\n  cert_file: server.crt\n  key_file: server.key\n")
+	conf, err := loadWebConfig(filepath.Join(dir, "web.yml"))
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(dir, "server.crt"), conf.TLSConfig.TLSCertPath)
+}
+
+// writeCertificate writes a self-signed certificate and its key as PEM files.
+func writeCertificate(t *testing.T, dir string, name string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+}
+
+func TestServeWebMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	writeCertificate(t, dir, "server")
+	writeCertificate(t, dir, "client")
+	filename := filepath.Join(dir, "web.yml")
+	writeWebConfig(t, filename, `tls_server_config:
+  cert_file: server.crt
+  key_file: server.key
+  client_auth_type: RequireAndVerifyClientCert
+  client_ca_file: client.crt
+`)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	handler, err := newWebHandler(filename, server.Handler)
+	require.NoError(t, err)
+	go serveWeb(l, server, handler)
+	defer server.Close()
+
+	serverCA := x509.NewCertPool()
+	serverPEM, err := os.ReadFile(filepath.Join(dir, "server.crt"))
+	require.NoError(t, err)
+	serverCA.AppendCertsFromPEM(serverPEM)
+	clientCert, err := tls.LoadX509KeyPair(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"))
+	require.NoError(t, err)
+
+	url := fmt.Sprintf("https://%s/", l.Addr())
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: serverCA}}}
+	_, err = client.Get(url)
+	require.Error(t, err)
+
+	client = &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: serverCA, Certificates: []tls.Certificate{clientCert}}}}
+	resp, err := client.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+}